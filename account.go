@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/rs/zerolog/log"
+	"go.mau.fi/util/dbutil"
+	"maunium.net/go/mautrix"
+	mcrypto "maunium.net/go/mautrix/crypto"
+	"maunium.net/go/mautrix/crypto/verificationhelper"
+	mevent "maunium.net/go/mautrix/event"
+	mid "maunium.net/go/mautrix/id"
+)
+
+// Account is one of the Matrix accounts the bot runs as. Each account has its
+// own client, encryption and conversations, and shares the database, the
+// backends and the job queue with the others.
+type Account struct {
+	client     *mautrix.Client
+	olmMachine *mcrypto.OlmMachine
+	keyBackup  *keyBackup
+	txt2txt    *Txt2txt
+	handler    *Handler
+
+	// Encrypted events waiting for their keys
+	undecryptable undecryptableEvents
+
+	// When the last successful sync finished in Unix nanoseconds, and
+	// whether the homeserver rejected the access token
+	lastSync  atomic.Int64
+	loginLost atomic.Bool
+}
+
+// newAccount logs into an account and loads its conversations.
+func newAccount(ctx context.Context, config *AccountConfig, db *sql.DB) (*Account, error) {
+	account := &Account{
+		txt2txt:       NewTxt2txt(config.Txt2TxtHistoryFile),
+		undecryptable: undecryptableEvents{events: make(map[megolmSession][]*pendingDecryption)},
+	}
+	if err := account.txt2txt.LoadHistories(); err != nil {
+		return nil, fmt.Errorf("couldn't load histories: %w", err)
+	}
+
+	client, err := mautrix.NewClient(config.Homeserver, mid.UserID(config.Username), "")
+	if err != nil {
+		return nil, fmt.Errorf("couldn't initialize the Matrix client: %w", err)
+	}
+	client.Log = log.Logger.With().Str("component", "matrix").Str("account", config.Username).Logger()
+	if err := login(ctx, client, config, db); err != nil {
+		return nil, fmt.Errorf("couldn't login to the homeserver: %w", err)
+	}
+	log.Info().Msgf("Logged in as %s/%s", client.UserID, client.DeviceID)
+
+	// set the client store on the client.
+	client.Store = Bot.stateStore
+	// The client encrypts events on its own once Crypto is set, which needs a
+	// state store that knows which rooms are encrypted.
+	client.StateStore = Bot.stateStore
+
+	account.client = client
+	account.handler = newHandler(client, account.txt2txt)
+	return account, nil
+}
+
+// setupEncryption loads the account's Olm machine and sets up cross-signing,
+// the key backup and device verification.
+func (a *Account) setupEncryption(ctx context.Context, config *Configuration, accountConfig *AccountConfig, db *sql.DB, dialect dbutil.Dialect) error {
+	utilDb, err := dbutil.NewWithDB(db, dialect.String())
+	if err != nil {
+		return err
+	}
+	// Setup the crypto store
+	sqlStore := mcrypto.NewSQLCryptoStore(
+		utilDb,
+		nil,
+		a.client.UserID.String(),
+		a.client.DeviceID,
+		pickleKey(config),
+	)
+	if err = sqlStore.DB.Upgrade(ctx); err != nil {
+		return fmt.Errorf("could not upgrade tables for the SQL crypto store: %w", err)
+	}
+
+	logger := a.client.Log
+	a.olmMachine = mcrypto.NewOlmMachine(a.client, &logger, sqlStore, Bot.stateStore)
+	err = a.olmMachine.Load(ctx)
+	if err != nil {
+		log.Error().Msg("'Could not initialize encryption support. Encrypted rooms will not work.")
+	}
+	a.client.Crypto = &cryptoHelper{mach: a.olmMachine}
+
+	ssssKey, err := setupCrossSigning(ctx, a.olmMachine, accountConfig)
+	if err != nil {
+		log.Error().Err(err).Msgf("Couldn't set up cross-signing, the device of %s will show as unverified", a.client.UserID)
+	}
+	if ssssKey != nil {
+		a.keyBackup, err = setupKeyBackup(ctx, a.olmMachine, ssssKey)
+		if err != nil {
+			log.Error().Err(err).Msgf("Couldn't set up key backup for %s, sessions will be lost with the database", a.client.UserID)
+		}
+	} else {
+		log.Warn().Msgf("Key backup for %s needs the recovery key, sessions will be lost with the database", a.client.UserID)
+	}
+
+	callbacks := &verificationCallbacks{timeout: sasTimeout}
+	helper := verificationhelper.NewVerificationHelper(a.client, a.olmMachine, callbacks, false)
+	callbacks.helper = helper
+	if err := helper.Init(ctx); err != nil {
+		log.Error().Err(err).Msg("Couldn't set up device verification")
+	}
+	return nil
+}
+
+// registerHandlers hooks the account's handlers up to its sync.
+func (a *Account) registerHandlers() {
+	syncer := a.client.Syncer.(*mautrix.DefaultSyncer)
+	// Hook up the OlmMachine into the Matrix client so it receives e2ee
+	// keys and other such things.
+	syncer.OnSync(func(_ context.Context, resp *mautrix.RespSync, since string) bool {
+		a.observeSync(nil)
+		a.olmMachine.ProcessSyncResponse(context.Background(), resp, since)
+		return true
+	})
+	syncer.OnEvent(Bot.stateStore.UpdateState)
+
+	syncer.OnEventType(mevent.StateMember, func(ctx context.Context, event *mevent.Event) {
+		a.olmMachine.HandleMemberEvent(ctx, event)
+
+		if event.GetStateKey() == a.client.UserID.String() && event.Content.AsMember().Membership == mevent.MembershipInvite {
+			log.Info().Msgf("'Joining %s as %s", event.RoomID, a.client.UserID)
+			_, err := DoRetry("join room", func() (interface{}, error) {
+				return a.client.JoinRoomByID(ctx, event.RoomID)
+			})
+			if err != nil {
+				log.Error().Err(err).Msgf("'Could not join channel %s", event.RoomID.String())
+			} else {
+				log.Info().Msgf("'Joined %s sucessfully", event.RoomID.String())
+			}
+		} else if event.GetStateKey() == a.client.UserID.String() && event.Content.AsMember().Membership.IsLeaveOrBan() {
+			log.Info().Msgf("'%s left or was banned from %s", a.client.UserID, event.RoomID)
+		}
+	})
+
+	syncer.OnEventType(mevent.EventMessage, func(ctx context.Context, event *mevent.Event) {
+		handleInBackground(ctx, event, a.handler.HandleMessage)
+	})
+
+	syncer.OnEventType(mevent.EventEncrypted, func(ctx context.Context, event *mevent.Event) {
+		decryptedEvent, err := a.decryptEvent(ctx, event)
+		if errors.Is(err, mcrypto.NoSessionFound) {
+			decryptionFailures.WithLabelValues("no_session").Inc()
+			log.Warn().Msgf("'No keys yet for message from %s in %s, waiting for them", event.Sender, event.RoomID)
+			a.parkUndecryptable(event, func(decryptedEvent *mevent.Event) {
+				syncer.Dispatch(context.Background(), decryptedEvent)
+			})
+		} else if err != nil {
+			decryptionFailures.WithLabelValues("error").Inc()
+			log.Error().Err(err).Msgf("'Failed to decrypt message from %s in %s", event.Sender, event.RoomID)
+		} else {
+			log.Debug().Msgf("'Received encrypted event from %s in %s", event.Sender, event.RoomID)
+			// Handle it like an unencrypted event, which includes in-room verification
+			syncer.Dispatch(ctx, decryptedEvent)
+		}
+	})
+}
+
+// sync runs the account's sync until ctx is cancelled.
+func (a *Account) sync(ctx context.Context) {
+	if a.keyBackup != nil {
+		go a.keyBackup.Run(ctx)
+	}
+	for ctx.Err() == nil {
+		log.Debug().Msgf("'Running sync for %s...", a.client.UserID)
+		err := a.client.SyncWithContext(ctx)
+		if err != nil && ctx.Err() == nil {
+			a.observeSync(err)
+			log.Error().Err(err).Msgf("Sync for %s failed", a.client.UserID)
+		}
+	}
+}
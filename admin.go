@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	mevent "maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/format"
+	mid "maunium.net/go/mautrix/id"
+)
+
+const adminHelp = `admin commands:
+
+| command | explanation |
+| --- | --- |
+| ` + "`!rooms`" + ` | list the rooms the bot is in |
+| ` + "`!leave <room id>`" + ` | leave a room |
+| ` + "`!reload`" + ` | re-read the configuration file, like sending SIGHUP |
+| ` + "`!queue`" + ` | show the jobs that are running right now |
+| ` + "`!backends`" + ` | check that the AI backends are reachable |
+| ` + "`!block <user id>`" + ` / ` + "`!unblock <user id>`" + ` | ignore or stop ignoring a user |
+| ` + "`!blocked`" + ` | list blocked users |
+| ` + "`!broadcast <message>`" + ` | send a notice to every room except this one |
+| ` + "`!verify <transaction>`" + ` / ` + "`!reject <transaction>`" + ` | confirm or reject the emojis of a device verification |
+`
+
+// isDebugRoom returns whether the room is the admin console configured as
+// debug_room.
+func (h *Handler) isDebugRoom(roomID mid.RoomID) bool {
+	debugRoom := h.config().DebugRoom
+	return debugRoom != "" && roomID.String() == debugRoom
+}
+
+// handleAdminCommand runs a command sent to the debug room. It returns false
+// if the message isn't an admin command, so that it can be handled normally.
+func (h *Handler) handleAdminCommand(ctx context.Context, event *mevent.Event, body string) bool {
+	command, args, _ := strings.Cut(body, " ")
+	args = strings.TrimSpace(args)
+
+	var handler func(context.Context, *mevent.Event, string)
+	switch command {
+	case "!help":
+		handler = func(ctx context.Context, event *mevent.Event, _ string) { h.sendMarkdown(ctx, event, adminHelp) }
+	case "!rooms":
+		handler = h.adminListRooms
+	case "!leave":
+		handler = h.adminLeaveRoom
+	case "!reload":
+		handler = h.adminReload
+	case "!queue":
+		handler = h.adminQueue
+	case "!backends":
+		handler = h.adminBackends
+	case "!block":
+		handler = h.adminBlock
+	case "!unblock":
+		handler = h.adminUnblock
+	case "!blocked":
+		handler = h.adminListBlocked
+	case "!broadcast":
+		handler = h.adminBroadcast
+	case "!verify":
+		handler = h.adminVerify
+	case "!reject":
+		handler = h.adminReject
+	default:
+		return false
+	}
+
+	// With no admins configured, nobody can run admin commands.
+	if !h.config().IsAdmin(event.Sender) {
+		h.sendReply(ctx, event, "Sorry, only admins can do that.")
+		return true
+	}
+
+	zerolog.Ctx(ctx).Info().Msgf("Running admin command %s from %s", command, event.Sender)
+	handler(ctx, event, args)
+	return true
+}
+
+func (h *Handler) adminListRooms(ctx context.Context, event *mevent.Event, _ string) {
+	rooms, err := h.sender.JoinedRooms(ctx)
+	if err != nil {
+		zerolog.Ctx(ctx).Error().Err(err).Msg("Failed to list joined rooms")
+		h.sendReply(ctx, event, fmt.Sprintf("Couldn't list rooms: %s", err))
+		return
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "joined %d rooms\n\n| room | name | members | encrypted |\n| --- | --- | --- | --- |\n", len(rooms))
+	for _, roomID := range rooms {
+		name := ""
+		if info, err := h.store.GetRoomInfo(ctx, roomID); err == nil {
+			name = info.Name
+		}
+		members, _ := h.store.GetRoomJoinedOrInvitedMembers(ctx, roomID)
+		encrypted, _ := h.store.IsEncrypted(ctx, roomID)
+		fmt.Fprintf(&sb, "| %s | %s | %d | %t |\n", roomID, name, len(members), encrypted)
+	}
+	h.sendMarkdown(ctx, event, sb.String())
+}
+
+func (h *Handler) adminLeaveRoom(ctx context.Context, event *mevent.Event, args string) {
+	roomID := mid.RoomID(args)
+	if !strings.HasPrefix(args, "!") {
+		h.sendReply(ctx, event, "usage: !leave <room id>")
+		return
+	}
+	if h.isDebugRoom(roomID) {
+		h.sendReply(ctx, event, "Refusing to leave the debug room.")
+		return
+	}
+
+	if err := h.sender.LeaveRoom(ctx, roomID); err != nil {
+		zerolog.Ctx(ctx).Error().Err(err).Msgf("Failed to leave %s", roomID)
+		h.sendReply(ctx, event, fmt.Sprintf("Couldn't leave %s: %s", roomID, err))
+		return
+	}
+	h.sendReaction(ctx, event, "👋")
+}
+
+func (h *Handler) adminReload(ctx context.Context, event *mevent.Event, _ string) {
+	result, err := reloadConfiguration()
+	if err != nil {
+		zerolog.Ctx(ctx).Error().Err(err).Msg("Failed to reload the configuration")
+		h.sendReply(ctx, event, fmt.Sprintf("Couldn't reload the configuration: %s", err))
+		return
+	}
+	h.sendMarkdown(ctx, event, result.String())
+}
+
+func (h *Handler) adminQueue(ctx context.Context, event *mevent.Event, _ string) {
+	jobs := ActiveJobs()
+	if len(jobs) == 0 {
+		h.sendReply(ctx, event, "Nothing is running.")
+		return
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%d jobs running\n\n| kind | backend | user | room | running for |\n| --- | --- | --- | --- | --- |\n", len(jobs))
+	for _, job := range jobs {
+		fmt.Fprintf(&sb, "| %s | %s | %s | %s | %s |\n", job.Kind, job.Backend, job.Event.Sender, job.Event.RoomID,
+			time.Since(job.Started).Round(time.Second))
+	}
+	h.sendMarkdown(ctx, event, sb.String())
+}
+
+func (h *Handler) adminBackends(ctx context.Context, event *mevent.Event, _ string) {
+	config := h.config()
+	backends := []struct {
+		kind   string
+		apiURL string
+	}{
+		{jobKindTxt2Img, config.Txt2ImgAPIURL},
+		{jobKindTxt2Txt, config.Txt2TxtAPIURL},
+	}
+
+	var sb strings.Builder
+	sb.WriteString("| kind | url | status |\n| --- | --- | --- |\n")
+	for _, backend := range backends {
+		status := "not configured"
+		if backend.apiURL != "" {
+			if latency, err := probeBackend(backend.apiURL); err != nil {
+				status = fmt.Sprintf("unreachable: %s", err)
+			} else {
+				status = fmt.Sprintf("reachable in %s", latency.Round(time.Millisecond))
+			}
+		}
+		fmt.Fprintf(&sb, "| %s | %s | %s |\n", backend.kind, backend.apiURL, status)
+	}
+	h.sendMarkdown(ctx, event, sb.String())
+}
+
+func (h *Handler) adminBlock(ctx context.Context, event *mevent.Event, args string) {
+	userID := mid.UserID(args)
+	if _, _, err := userID.Parse(); err != nil {
+		h.sendReply(ctx, event, "usage: !block <user id>")
+		return
+	}
+	if err := h.store.BlockUser(ctx, userID, event.Sender); err != nil {
+		zerolog.Ctx(ctx).Error().Err(err).Msgf("Failed to block %s", userID)
+		h.sendReply(ctx, event, fmt.Sprintf("Couldn't block %s: %s", userID, err))
+		return
+	}
+	h.sendReaction(ctx, event, "🚫")
+}
+
+func (h *Handler) adminUnblock(ctx context.Context, event *mevent.Event, args string) {
+	userID := mid.UserID(args)
+	if _, _, err := userID.Parse(); err != nil {
+		h.sendReply(ctx, event, "usage: !unblock <user id>")
+		return
+	}
+	if err := h.store.UnblockUser(ctx, userID); err != nil {
+		zerolog.Ctx(ctx).Error().Err(err).Msgf("Failed to unblock %s", userID)
+		h.sendReply(ctx, event, fmt.Sprintf("Couldn't unblock %s: %s", userID, err))
+		return
+	}
+	h.sendReaction(ctx, event, "✔️")
+}
+
+func (h *Handler) adminListBlocked(ctx context.Context, event *mevent.Event, _ string) {
+	users, err := h.store.ListBlocked(ctx)
+	if err != nil {
+		zerolog.Ctx(ctx).Error().Err(err).Msg("Failed to list blocked users")
+		h.sendReply(ctx, event, fmt.Sprintf("Couldn't list blocked users: %s", err))
+		return
+	}
+	if len(users) == 0 {
+		h.sendReply(ctx, event, "Nobody is blocked.")
+		return
+	}
+
+	var sb strings.Builder
+	sb.WriteString("| user | blocked by | since |\n| --- | --- | --- |\n")
+	for _, user := range users {
+		fmt.Fprintf(&sb, "| %s | %s | %s |\n", user.UserID, user.BlockedBy, user.CreatedAt.UTC().Format(time.RFC3339))
+	}
+	h.sendMarkdown(ctx, event, sb.String())
+}
+
+func (h *Handler) adminBroadcast(ctx context.Context, event *mevent.Event, args string) {
+	if args == "" {
+		h.sendReply(ctx, event, "usage: !broadcast <message>")
+		return
+	}
+
+	rooms, err := h.sender.JoinedRooms(ctx)
+	if err != nil {
+		zerolog.Ctx(ctx).Error().Err(err).Msg("Failed to list joined rooms")
+		h.sendReply(ctx, event, fmt.Sprintf("Couldn't list rooms: %s", err))
+		return
+	}
+
+	sent, total := 0, 0
+	for _, roomID := range rooms {
+		if h.isDebugRoom(roomID) {
+			continue
+		}
+		total++
+		if err := h.sendNotice(ctx, roomID, args); err == nil {
+			sent++
+		}
+	}
+	h.sendReply(ctx, event, fmt.Sprintf("Sent to %d of %d rooms.", sent, total))
+}
+
+func (h *Handler) adminVerify(ctx context.Context, event *mevent.Event, args string) {
+	if args == "" {
+		h.sendReply(ctx, event, "usage: !verify <transaction>")
+		return
+	}
+	if err := pendingSAS.confirm(ctx, mid.VerificationTransactionID(args)); err != nil {
+		zerolog.Ctx(ctx).Error().Err(err).Msgf("Failed to confirm verification %s", args)
+		h.sendReply(ctx, event, fmt.Sprintf("Couldn't confirm verification %s: %s", args, err))
+		return
+	}
+	h.sendReaction(ctx, event, "✔️")
+}
+
+func (h *Handler) adminReject(ctx context.Context, event *mevent.Event, args string) {
+	if args == "" {
+		h.sendReply(ctx, event, "usage: !reject <transaction>")
+		return
+	}
+	err := pendingSAS.reject(ctx, mid.VerificationTransactionID(args), mevent.VerificationCancelCodeSASMismatch, "The emojis don't match")
+	if err != nil {
+		zerolog.Ctx(ctx).Error().Err(err).Msgf("Failed to reject verification %s", args)
+		h.sendReply(ctx, event, fmt.Sprintf("Couldn't reject verification %s: %s", args, err))
+		return
+	}
+	h.sendReaction(ctx, event, "✔️")
+}
+
+// sendNotice renders markdown text as an m.notice and sends it to a room.
+func (h *Handler) sendNotice(ctx context.Context, roomID mid.RoomID, text string) error {
+	content := format.RenderMarkdown(text, true, false)
+	content.MsgType = mevent.MsgNotice
+	_, err := h.sender.SendMessage(ctx, roomID, &content)
+	return err
+}
+
+// notifyDebugRoom posts a notice to the debug room, if one is configured.
+func (h *Handler) notifyDebugRoom(text string) {
+	debugRoom := h.config().DebugRoom
+	if debugRoom == "" {
+		return
+	}
+	if err := h.sendNotice(context.Background(), mid.RoomID(debugRoom), text); err != nil {
+		log.Error().Err(err).Msg("Failed to notify the debug room")
+	}
+}
+
+// notifyDebugRoom posts a notice to the debug room from the first account.
+func notifyDebugRoom(text string) {
+	if len(Bot.accounts) > 0 {
+		Bot.accounts[0].handler.notifyDebugRoom(text)
+	}
+}
+
+// reportPanic recovers from a panic while handling an event and reports it to
+// the debug room. It must be deferred.
+func (h *Handler) reportPanic(event *mevent.Event) {
+	if r := recover(); r != nil {
+		stack := debug.Stack()
+		log.Error().Msgf("Panic while handling %s: %v\n%s", event.ID, r, stack)
+		h.notifyDebugRoom(fmt.Sprintf("panic while handling %s from %s in %s: %v\n\n```\n%s\n```",
+			event.ID, event.Sender, event.RoomID, r, stack))
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"maunium.net/go/mautrix"
+	mcrypto "maunium.net/go/mautrix/crypto"
+	"maunium.net/go/mautrix/crypto/backup"
+	"maunium.net/go/mautrix/crypto/signatures"
+	"maunium.net/go/mautrix/crypto/ssss"
+	mevent "maunium.net/go/mautrix/event"
+	mid "maunium.net/go/mautrix/id"
+)
+
+const keyBackupInterval = time.Minute
+
+// keyBackup keeps the bot's inbound Megolm sessions in server-side key backup
+// (m.megolm_backup.v1), so that a new device can still decrypt old messages.
+type keyBackup struct {
+	mach    *mcrypto.OlmMachine
+	key     *backup.MegolmBackupKey
+	version mid.KeyBackupVersion
+	lock    sync.Mutex
+}
+
+// setupKeyBackup reads the backup key from secret storage, or creates a new
+// backup if there is none yet. When the backup is newer than what the crypto
+// store has seen, for example on a fresh device, every session is restored.
+func setupKeyBackup(ctx context.Context, mach *mcrypto.OlmMachine, ssssKey *ssss.Key) (*keyBackup, error) {
+	keyData, err := mach.SSSS.GetDecryptedAccountData(ctx, mevent.AccountDataMegolmBackupKey, ssssKey)
+	if errors.Is(err, mautrix.MNotFound) {
+		return createKeyBackup(ctx, mach, ssssKey)
+	} else if err != nil {
+		return nil, fmt.Errorf("couldn't get the backup key from secret storage: %w", err)
+	}
+
+	key, err := backup.MegolmBackupKeyFromBytes(keyData)
+	if err != nil {
+		return nil, fmt.Errorf("invalid backup key in secret storage: %w", err)
+	}
+
+	versionInfo, err := mach.GetAndVerifyLatestKeyBackupVersion(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get the latest key backup: %w", err)
+	}
+	if versionInfo.AuthData.PublicKey != backupPublicKey(key) {
+		return nil, fmt.Errorf("key backup %s doesn't match the backup key in secret storage", versionInfo.Version)
+	}
+
+	kb := &keyBackup{mach: mach, key: key, version: versionInfo.Version}
+	if mach.KeyBackupVersion() != versionInfo.Version {
+		log.Info().Msgf("Restoring %d sessions from key backup %s", versionInfo.Count, versionInfo.Version)
+		if err := mach.GetAndStoreKeyBackup(ctx, versionInfo.Version, key); err != nil {
+			return nil, fmt.Errorf("couldn't restore key backup %s: %w", versionInfo.Version, err)
+		}
+		if err := mach.SetKeyBackupVersion(ctx, versionInfo.Version); err != nil {
+			return nil, err
+		}
+	}
+	return kb, nil
+}
+
+// createKeyBackup creates a new backup version signed with our master key and
+// stores its private key in secret storage.
+func createKeyBackup(ctx context.Context, mach *mcrypto.OlmMachine, ssssKey *ssss.Key) (*keyBackup, error) {
+	if mach.CrossSigningKeys == nil {
+		return nil, errors.New("cross-signing keys are needed to sign a new key backup")
+	}
+
+	key, err := backup.NewMegolmBackupKey()
+	if err != nil {
+		return nil, err
+	}
+
+	authData := backup.MegolmAuthData{PublicKey: backupPublicKey(key)}
+	masterKey := mach.CrossSigningKeys.MasterKey
+	signature, err := masterKey.SignJSON(authData)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't sign the key backup: %w", err)
+	}
+	authData.Signatures = signatures.NewSingleSignature(mach.Client.UserID, mid.KeyAlgorithmEd25519, masterKey.PublicKey().String(), signature)
+
+	resp, err := mach.Client.CreateKeyBackupVersion(ctx, &mautrix.ReqRoomKeysVersionCreate[backup.MegolmAuthData]{
+		Algorithm: mid.KeyBackupAlgorithmMegolmBackupV1,
+		AuthData:  authData,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create a key backup: %w", err)
+	}
+	if err := mach.SSSS.SetEncryptedAccountData(ctx, mevent.AccountDataMegolmBackupKey, key.Bytes(), ssssKey); err != nil {
+		return nil, fmt.Errorf("couldn't store the backup key in secret storage: %w", err)
+	}
+	log.Info().Msgf("Created key backup %s", resp.Version)
+
+	return &keyBackup{mach: mach, key: key, version: resp.Version}, nil
+}
+
+func backupPublicKey(key *backup.MegolmBackupKey) mid.Ed25519 {
+	return mid.Ed25519(base64.RawStdEncoding.EncodeToString(key.PublicKey().Bytes()))
+}
+
+// Run uploads new sessions to the backup until the context is cancelled.
+func (kb *keyBackup) Run(ctx context.Context) {
+	ticker := time.NewTicker(keyBackupInterval)
+	defer ticker.Stop()
+	for {
+		if err := kb.Upload(ctx); err != nil {
+			log.Error().Err(err).Msg("Failed to upload sessions to key backup")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Upload backs up every inbound session that isn't in the current backup yet.
+func (kb *keyBackup) Upload(ctx context.Context) error {
+	kb.lock.Lock()
+	defer kb.lock.Unlock()
+
+	sessions, err := kb.mach.CryptoStore.GetGroupSessionsWithoutKeyBackupVersion(ctx, kb.version).AsList()
+	if err != nil {
+		return err
+	}
+	if len(sessions) == 0 {
+		return nil
+	}
+
+	req := &mautrix.ReqKeyBackup{Rooms: make(map[mid.RoomID]mautrix.ReqRoomKeyBackup)}
+	// Sessions that failed to encrypt aren't in the request, and are retried
+	// on the next upload
+	var uploaded []*mcrypto.InboundGroupSession
+	for _, session := range sessions {
+		data, err := kb.encryptSession(session)
+		if err != nil {
+			log.Warn().Err(err).Msgf("Failed to back up session %s in %s", session.ID(), session.RoomID)
+			continue
+		}
+		room, ok := req.Rooms[session.RoomID]
+		if !ok {
+			room = mautrix.ReqRoomKeyBackup{Sessions: make(map[mid.SessionID]mautrix.ReqKeyBackupData)}
+			req.Rooms[session.RoomID] = room
+		}
+		room.Sessions[session.ID()] = *data
+		uploaded = append(uploaded, session)
+	}
+	if len(uploaded) == 0 {
+		return nil
+	}
+
+	if _, err := kb.mach.Client.PutKeysInBackup(ctx, kb.version, req); err != nil {
+		return err
+	}
+	for _, session := range uploaded {
+		session.KeyBackupVersion = kb.version
+		if err := kb.mach.CryptoStore.PutGroupSession(ctx, session.RoomID, session.SenderKey, session.ID(), session); err != nil {
+			return err
+		}
+	}
+	log.Debug().Msgf("Uploaded %d sessions to key backup %s", len(uploaded), kb.version)
+	return nil
+}
+
+func (kb *keyBackup) encryptSession(session *mcrypto.InboundGroupSession) (*mautrix.ReqKeyBackupData, error) {
+	firstIndex := session.Internal.FirstKnownIndex()
+	exported, err := session.Internal.Export(firstIndex)
+	if err != nil {
+		return nil, err
+	}
+
+	encrypted, err := backup.EncryptSessionData(kb.key, backup.MegolmSessionData{
+		Algorithm:          mid.AlgorithmMegolmV1,
+		ForwardingKeyChain: session.ForwardingChains,
+		SenderClaimedKeys:  backup.SenderClaimedKeys{Ed25519: session.SigningKey},
+		SenderKey:          session.SenderKey,
+		SessionKey:         string(exported),
+	})
+	if err != nil {
+		return nil, err
+	}
+	sessionData, err := json.Marshal(encrypted)
+	if err != nil {
+		return nil, err
+	}
+
+	return &mautrix.ReqKeyBackupData{
+		FirstMessageIndex: int(firstIndex),
+		ForwardedCount:    len(session.ForwardingChains),
+		SessionData:       sessionData,
+	}, nil
+}
+
+// RestoreSession fetches a single session from the backup, for events that
+// arrive before the session does or that predate this device.
+func (kb *keyBackup) RestoreSession(ctx context.Context, roomID mid.RoomID, sessionID mid.SessionID) error {
+	resp, err := kb.mach.Client.GetKeyBackupForRoomAndSession(ctx, kb.version, roomID, sessionID)
+	if err != nil {
+		return err
+	}
+	sessionData, err := resp.SessionData.Decrypt(kb.key)
+	if err != nil {
+		return err
+	}
+	return kb.mach.ImportRoomKeyFromBackup(ctx, kb.version, roomID, sessionID, sessionData)
+}
@@ -5,18 +5,16 @@ import (
 	"context"
 	"database/sql"
 	"flag"
+	"fmt"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
 	"syscall"
 
 	// _ "github.com/motemen/go-loghttp/global"
 
-	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
-	"go.mau.fi/util/dbutil"
-	"maunium.net/go/mautrix"
-	mcrypto "maunium.net/go/mautrix/crypto"
-	mevent "maunium.net/go/mautrix/event"
 	mid "maunium.net/go/mautrix/id"
 )
 
@@ -24,170 +22,152 @@ var Bot BotType
 
 func main() {
 	configPath := flag.String("config", "config.yaml", "Path to the configuration file")
-	dbFilename := flag.String("dbfile", "./state.db", "the SQLite DB file to use")
+	dbFilename := flag.String("dbfile", "./state.db", "the SQLite DB file to use, unless database_uri is configured")
+	migrateOnlyFlag := flag.Bool("migrate-only", false, "Upgrade the database schema and exit")
+	logoutFlag := flag.Bool("logout", false, "Log out the bot's device, forget its session and exit")
+	rekeyFlag := flag.Bool("rekey-crypto-store", false, "Re-encrypt the crypto store with the configured pickle key and exit")
+	oldPickleKeyFile := flag.String("old-pickle-key-file", "", "File with the pickle key the crypto store is encrypted with now, for -rekey-crypto-store (default: the legacy built-in key)")
 	flag.Parse()
 
-	// Configure logging
-	// log.SetFormatter(&log.JSONFormatter{})
-	zerolog.SetGlobalLevel(zerolog.DebugLevel)
-	log.Info().Msg("Starting")
-
 	// Load configuration
-	configBytes, err := os.ReadFile(*configPath)
+	Bot.configPath = *configPath
+	config, err := LoadConfiguration(*configPath)
 	if err != nil {
-		log.Fatal().Msgf("Couldn't open the configuration file at %s: %s", *configPath, err)
-	}
-
-	Bot.configuration = Configuration{}
-	if err := Bot.configuration.Parse(configBytes); err != nil {
-		log.Fatal().Msg("Failed to read config!")
+		log.Fatal().Msgf("Couldn't read the configuration file at %s: %s", *configPath, err)
 	}
+	Bot.configuration.Store(config)
 
-	username := mid.UserID(Bot.configuration.Username)
-	_, _, err = username.Parse()
-	if err != nil {
-		log.Fatal().Msgf("Couldn't parse username: %s", username)
-	}
+	Bot.log = setupLogging(config)
+	log.Info().Msg("Starting")
 
 	// Open the config database
-	db, err := sql.Open("sqlite3", *dbFilename)
+	databaseURI := config.DatabaseURI
+	if databaseURI == "" {
+		databaseURI = *dbFilename
+	}
+	db, dialect, err := openDatabase(databaseURI)
 	if err != nil {
 		log.Fatal().Msg("Could not open database.")
 	}
 
-	// Make sure to exit cleanly
+	// Make sure to exit cleanly: the first signal stops the sync and lets
+	// running jobs finish, a second one exits right away
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
 	c := make(chan os.Signal, 1)
 	signal.Notify(c,
 		os.Interrupt,
 		os.Kill,
 		syscall.SIGABRT,
-		syscall.SIGHUP,
 		syscall.SIGINT,
 		syscall.SIGQUIT,
 		syscall.SIGTERM,
 	)
 	go func() {
-		for range c { // when the process is killed
-			log.Info().Msgf("'Cleaning up")
-			db.Close()
-			Bot.txt2txt.SaveHistories()
-			os.Exit(0)
-		}
+		<-c
+		log.Info().Msg("Shutting down, signal again to exit immediately")
+		stop()
+		<-c
+		log.Warn().Msg("Exiting immediately")
+		os.Exit(1)
 	}()
 
-	Bot.txt2txt = NewTxt2txt()
-	err = Bot.txt2txt.LoadHistories()
-	if err != nil {
-		log.Fatal().Err(err).Msg("Couldn't load histories")
-	}
-
-	Bot.stateStore = store.NewStateStore(db)
-	if err := Bot.stateStore.CreateTables(); err != nil {
-		log.Fatal().Err(err).Msg("Failed to create tables.")
-	}
+	// Reload the configuration on SIGHUP
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			log.Info().Msg("Reloading the configuration")
+			result, err := reloadConfiguration()
+			if err != nil {
+				log.Error().Err(err).Msg("Failed to reload the configuration")
+				notifyDebugRoom(fmt.Sprintf("couldn't reload the configuration: %s", err))
+				continue
+			}
+			applyLogLevel(Bot.Config())
+			log.Info().Strs("applied", result.Applied).Strs("need_restart", result.NeedRestart).Msg("Reloaded the configuration")
+			notifyDebugRoom(result.String())
+		}
+	}()
 
-	deviceID := FindDeviceID(db, username.String())
-	if len(deviceID) > 0 {
-		log.Info().Msgf("'Found existing device ID in database: %s", deviceID)
+	Bot.stateStore = store.NewStateStore(db, dialect)
+	if err := Bot.stateStore.Upgrade(context.Background()); err != nil {
+		log.Fatal().Err(err).Msg("Failed to upgrade the database schema.")
 	}
-
-	Bot.client, err = mautrix.NewClient(Bot.configuration.Homeserver, "", "")
-	if err != nil {
-		log.Fatal().Msg("Couldn't initialize the Matrix client")
+	if *migrateOnlyFlag {
+		log.Info().Msg("The database schema is up to date")
+		return
 	}
+	Bot.limiter = NewLimiter(Bot.stateStore, Bot.Config)
 
-	_, err = DoRetry("login", func() (interface{}, error) {
-		return Bot.client.Login(context.Background(), &mautrix.ReqLogin{
-			Type: mautrix.AuthTypePassword,
-			Identifier: mautrix.UserIdentifier{
-				Type: mautrix.IdentifierTypeUser,
-				User: username.String(),
-			},
-			Password:                 Bot.configuration.Password,
-			InitialDeviceDisplayName: Bot.configuration.DisplayName,
-			DeviceID:                 deviceID,
-			StoreCredentials:         true,
-		})
-	})
-	if err != nil {
-		log.Fatal().Msgf("Couldn't login to the homeserver.")
-	}
-	log.Info().Msgf("Logged in as %s/%s", Bot.client.UserID, Bot.client.DeviceID)
-
-	// set the client store on the client.
-	Bot.client.Store = Bot.stateStore
-
-	utilDb, err := dbutil.NewWithDB(db, "sqlite3")
-	// Setup the crypto store
-	sqlStore := mcrypto.NewSQLCryptoStore(
-		utilDb,
-		nil,
-		username.String(),
-		Bot.client.DeviceID,
-		[]byte("standupbot_cryptostore_key"),
-	)
-	if err = sqlStore.DB.Upgrade(context.Background()); err != nil {
-		log.Fatal().Msg("Could not upgrade tables for the SQL crypto store.")
-	}
-
-	Bot.olmMachine = mcrypto.NewOlmMachine(Bot.client, Bot.log, sqlStore, Bot.stateStore)
-	err = Bot.olmMachine.Load(context.Background())
-	if err != nil {
-		log.Error().Msg("'Could not initialize encryption support. Encrypted rooms will not work.")
-	}
-
-	syncer := Bot.client.Syncer.(*mautrix.DefaultSyncer)
-	// Hook up the OlmMachine into the Matrix client so it receives e2ee
-	// keys and other such things.
-	syncer.OnSync(func(_ context.Context, resp *mautrix.RespSync, since string) bool {
-		Bot.olmMachine.ProcessSyncResponse(context.Background(), resp, since)
-		return true
-	})
-
-	syncer.OnEventType(mevent.StateMember, func(ctx context.Context, event *mevent.Event) {
-		Bot.olmMachine.HandleMemberEvent(ctx, event)
-		Bot.stateStore.SetMembership(event)
-
-		if event.GetStateKey() == username.String() && event.Content.AsMember().Membership == mevent.MembershipInvite {
-			log.Info().Msgf("'Joining %s", event.RoomID)
-			_, err := DoRetry("join room", func() (interface{}, error) {
-				return Bot.client.JoinRoomByID(ctx, event.RoomID)
-			})
+	if *rekeyFlag {
+		if config.PickleKey == "" {
+			log.Fatal().Msg("Configure the new pickle_key before running -rekey-crypto-store")
+		}
+		oldKey := []byte(legacyPickleKey)
+		if *oldPickleKeyFile != "" {
+			key, err := readSecretFile(*oldPickleKeyFile)
 			if err != nil {
-				log.Error().Err(err).Msgf("'Could not join channel %s", event.RoomID.String())
-			} else {
-				log.Info().Msgf("'Joined %s sucessfully", event.RoomID.String())
+				log.Fatal().Err(err).Msg("Couldn't read the old pickle key")
 			}
-		} else if event.GetStateKey() == username.String() && event.Content.AsMember().Membership.IsLeaveOrBan() {
-			log.Info().Msgf("'Left or banned from %s", event.RoomID)
+			oldKey = []byte(key)
 		}
-	})
-
-	syncer.OnEventType(mevent.StateEncryption, func(_ context.Context, event *mevent.Event) {
-		Bot.stateStore.SetEncryptionEvent(event)
-	})
-
-	syncer.OnEventType(mevent.EventMessage, func(ctx context.Context, event *mevent.Event) { go HandleMessage(ctx, event) })
-
-	syncer.OnEventType(mevent.EventEncrypted, func(ctx context.Context, event *mevent.Event) {
-		decryptedEvent, err := Bot.olmMachine.DecryptMegolmEvent(context.Background(), event)
+		migrated, err := rekeyCryptoStore(context.Background(), db, dialect, oldKey, []byte(config.PickleKey))
 		if err != nil {
-			log.Error().Err(err).Msgf("'Failed to decrypt message from %s in %s", event.Sender, event.RoomID)
-		} else {
-			log.Debug().Msgf("'Received encrypted event from %s in %s", event.Sender, event.RoomID)
-			if decryptedEvent.Type == mevent.EventMessage {
-				go HandleMessage(ctx, decryptedEvent)
+			log.Fatal().Err(err).Msg("Couldn't re-encrypt the crypto store")
+		}
+		log.Info().Msgf("Re-encrypted %d rows of the crypto store with the new pickle key", migrated)
+		return
+	}
+
+	accountConfigs := config.AccountConfigs()
+	if *logoutFlag {
+		for i := range accountConfigs {
+			if err := logout(context.Background(), &accountConfigs[i], db); err != nil {
+				log.Fatal().Err(err).Msgf("Couldn't log out %s", accountConfigs[i].Username)
 			}
 		}
-	})
+		return
+	}
 
-	for {
-		log.Debug().Msg("'Running sync...")
-		err = Bot.client.Sync()
+	for i := range accountConfigs {
+		accountConfig := &accountConfigs[i]
+		account, err := newAccount(context.Background(), accountConfig, db)
 		if err != nil {
-			log.Error().Err(err).Msg("Sync failed")
+			log.Fatal().Err(err).Msgf("Couldn't start %s", accountConfig.Username)
+		}
+
+		if err := account.setupEncryption(context.Background(), config, accountConfig, db, dialect); err != nil {
+			log.Fatal().Err(err).Msgf("Couldn't set up encryption for %s", accountConfig.Username)
 		}
+		// Only the first account answers admin commands in the debug room
+		account.handler.admin = i == 0
+		account.registerHandlers()
+		Bot.accounts = append(Bot.accounts, account)
+	}
+
+	if config.DebugRoom != "" && len(config.Admins) == 0 {
+		log.Warn().Msg("No admins are configured, so admin commands in the debug room are refused")
 	}
+
+	if config.MetricsListen != "" {
+		Bot.httpServer = startHTTPServer(config.MetricsListen)
+	}
+
+	var started []string
+	var wg sync.WaitGroup
+	for _, account := range Bot.accounts {
+		started = append(started, fmt.Sprintf("%s/%s", account.client.UserID, account.client.DeviceID))
+		wg.Add(1)
+		go func(account *Account) {
+			defer wg.Done()
+			account.sync(ctx)
+		}(account)
+	}
+	notifyDebugRoom(fmt.Sprintf("started as %s", strings.Join(started, ", ")))
+
+	wg.Wait()
+	shutdown(db)
 }
 
 func FindDeviceID(db *sql.DB, accountID string) (deviceID mid.DeviceID) {
@@ -1,7 +1,18 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog"
 	"gopkg.in/yaml.v2"
+	mid "maunium.net/go/mautrix/id"
 )
 
 type Configuration struct {
@@ -10,15 +21,569 @@ type Configuration struct {
 	Txt2TxtHistoryFile string `yaml:"txt2txt_history_file"`
 
 	// Authentication
-	Password   string `yaml:"password"`
-	Username   string `yaml:"username"`
-	Homeserver string `yaml:"homeserver"`
+	Password     string `yaml:"password"`
+	PasswordFile string `yaml:"password_file"`
+	// A pre-issued access token can be used instead of a password
+	AccessToken     string `yaml:"access_token"`
+	AccessTokenFile string `yaml:"access_token_file"`
+	Username        string `yaml:"username"`
+	Homeserver      string `yaml:"homeserver"`
+
+	// Where the bot keeps its state: a postgres:// URI or an SQLite file
+	DatabaseURI string `yaml:"database_uri"`
+
+	// Encrypts the Olm and Megolm sessions in the crypto store
+	PickleKey     string `yaml:"pickle_key"`
+	PickleKeyFile string `yaml:"pickle_key_file"`
+
+	// Unlocks the cross-signing keys kept in secret storage
+	RecoveryKey     string `yaml:"recovery_key"`
+	RecoveryKeyFile string `yaml:"recovery_key_file"`
 
 	// Bot
 	DisplayName string `yaml:"display_name"`
 	DebugRoom   string `yaml:"debug_room"`
+
+	// Several accounts can run in one process instead of the single account
+	// configured above. They share everything else.
+	Accounts []AccountConfig `yaml:"accounts"`
+
+	// Users allowed to run admin commands such as exporting usage
+	Admins []string `yaml:"admins"`
+
+	// How many seconds to wait for the keys of a message the bot can't decrypt
+	// yet, and whether to react with a 🔒 in the meantime
+	DecryptionTimeout    int  `yaml:"decryption_timeout"`
+	ReactToUndecryptable bool `yaml:"react_to_undecryptable"`
+
+	// How many seconds running jobs get to finish when the bot is stopped
+	ShutdownTimeout int `yaml:"shutdown_timeout"`
+
+	// Address of the HTTP listener serving /metrics, /healthz and /readyz,
+	// e.g. ":9100". Disabled when empty
+	MetricsListen string `yaml:"metrics_listen"`
+	// How many seconds without a successful sync make /healthz fail
+	HealthMaxSyncAge int `yaml:"health_max_sync_age"`
+
+	// Logging: the level, json or console lines, and whether messages and
+	// prompts may appear in the logs
+	LogLevel          string `yaml:"log_level"`
+	LogFormat         string `yaml:"log_format"`
+	LogMessageContent bool   `yaml:"log_message_content"`
+
+	// Limits
+	Limits Limits `yaml:"limits"`
+}
+
+// AccountConfig is a Matrix account the bot runs as.
+type AccountConfig struct {
+	Username        string `yaml:"username"`
+	Homeserver      string `yaml:"homeserver"`
+	Password        string `yaml:"password"`
+	PasswordFile    string `yaml:"password_file"`
+	AccessToken     string `yaml:"access_token"`
+	AccessTokenFile string `yaml:"access_token_file"`
+	RecoveryKey     string `yaml:"recovery_key"`
+	RecoveryKeyFile string `yaml:"recovery_key_file"`
+
+	DisplayName string `yaml:"display_name"`
+	// The commands the account answers, out of chat and images. All of them
+	// when empty
+	Features []string `yaml:"features"`
+	// Instructions for the chat backend that come before every conversation
+	Persona            string `yaml:"persona"`
+	PersonaFile        string `yaml:"persona_file"`
+	Txt2TxtHistoryFile string `yaml:"txt2txt_history_file"`
+}
+
+const (
+	featureChat   = "chat"
+	featureImages = "images"
+)
+
+// HasFeature returns whether the account answers the commands of a feature.
+func (a *AccountConfig) HasFeature(feature string) bool {
+	if len(a.Features) == 0 {
+		return true
+	}
+	for _, f := range a.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
 }
 
+// sameLogin returns whether two account configurations log into the same
+// account in the same way.
+func (a *AccountConfig) sameLogin(other *AccountConfig) bool {
+	return a.Username == other.Username && a.Homeserver == other.Homeserver &&
+		a.Password == other.Password && a.AccessToken == other.AccessToken &&
+		a.RecoveryKey == other.RecoveryKey && a.Txt2TxtHistoryFile == other.Txt2TxtHistoryFile
+}
+
+// AccountConfigs returns the accounts the bot runs as. Without an accounts
+// list, that is the single account of the top-level settings.
+func (c *Configuration) AccountConfigs() []AccountConfig {
+	if len(c.Accounts) > 0 {
+		return c.Accounts
+	}
+	return []AccountConfig{{
+		Username:           c.Username,
+		Homeserver:         c.Homeserver,
+		Password:           c.Password,
+		AccessToken:        c.AccessToken,
+		RecoveryKey:        c.RecoveryKey,
+		DisplayName:        c.DisplayName,
+		Txt2TxtHistoryFile: c.Txt2TxtHistoryFile,
+	}}
+}
+
+// Account returns the configuration of one of the bot's accounts, or nil.
+func (c *Configuration) Account(userID mid.UserID) *AccountConfig {
+	accounts := c.AccountConfigs()
+	for i := range accounts {
+		if accounts[i].Username == userID.String() {
+			return &accounts[i]
+		}
+	}
+	return nil
+}
+
+// IsAccount returns whether a user is one of the bot's own accounts.
+func (c *Configuration) IsAccount(userID mid.UserID) bool {
+	return c.Account(userID) != nil
+}
+
+// Limits configures the rate limits and daily quotas applied to every user
+// and every room. A zero value disables the corresponding limit.
+type Limits struct {
+	User LimitSettings `yaml:"user"`
+	Room LimitSettings `yaml:"room"`
+}
+
+type LimitSettings struct {
+	// Token bucket: up to Burst commands at once, refilled at PerMinute.
+	Burst     int     `yaml:"burst"`
+	PerMinute float64 `yaml:"per_minute"`
+
+	// Daily quotas, reset at midnight UTC.
+	DailyImages int `yaml:"daily_images"`
+	DailyTokens int `yaml:"daily_tokens"`
+}
+
+// envPrefix is prepended to the upper-cased yaml names of the settings to get
+// the environment variables that override them, e.g. BOT_PASSWORD or
+// BOT_LIMITS_USER_BURST.
+const envPrefix = "BOT"
+
+// Parse decodes the YAML configuration. Unknown keys are rejected so that
+// typos don't silently leave a setting empty.
 func (c *Configuration) Parse(data []byte) error {
-	return yaml.Unmarshal(data, c)
+	return yaml.UnmarshalStrict(data, c)
+}
+
+// SetDefaults fills in the settings that have a default value and were left
+// empty.
+func (c *Configuration) SetDefaults() {
+	if c.Txt2TxtHistoryFile == "" {
+		c.Txt2TxtHistoryFile = "ai_history.json"
+	}
+	if c.DisplayName == "" {
+		c.DisplayName = "bot"
+	}
+	if c.DecryptionTimeout == 0 {
+		c.DecryptionTimeout = 300
+	}
+	if c.ShutdownTimeout == 0 {
+		c.ShutdownTimeout = 60
+	}
+	if c.HealthMaxSyncAge == 0 {
+		c.HealthMaxSyncAge = 300
+	}
+	if c.LogLevel == "" {
+		c.LogLevel = "info"
+	}
+	if c.LogFormat == "" {
+		c.LogFormat = logFormatJSON
+	}
+	for i := range c.Accounts {
+		account := &c.Accounts[i]
+		if account.DisplayName == "" {
+			account.DisplayName = "bot"
+		}
+		if account.Txt2TxtHistoryFile == "" {
+			// Every account keeps its own conversations, next to the
+			// top-level history file
+			ext := filepath.Ext(c.Txt2TxtHistoryFile)
+			account.Txt2TxtHistoryFile = fmt.Sprintf("%s-%s%s",
+				strings.TrimSuffix(c.Txt2TxtHistoryFile, ext), mid.UserID(account.Username).Localpart(), ext)
+		}
+	}
+}
+
+// ApplyEnvironment overrides settings with the BOT_* environment variables
+// returned by lookup. Lists are comma separated.
+func (c *Configuration) ApplyEnvironment(lookup func(string) (string, bool)) error {
+	return applyEnvironment(reflect.ValueOf(c).Elem(), envPrefix, lookup)
+}
+
+func applyEnvironment(v reflect.Value, prefix string, lookup func(string) (string, bool)) error {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		name := prefix + "_" + strings.ToUpper(yamlName(v.Type().Field(i)))
+
+		if field.Kind() == reflect.Slice && field.Type().Elem().Kind() != reflect.String {
+			// The accounts can only be configured in the file
+			continue
+		}
+		if field.Kind() == reflect.Struct {
+			if err := applyEnvironment(field, name, lookup); err != nil {
+				return err
+			}
+			continue
+		}
+
+		value, ok := lookup(name)
+		if !ok {
+			continue
+		}
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(value)
+		case reflect.Int:
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return fmt.Errorf("%s must be an integer: %w", name, err)
+			}
+			field.SetInt(n)
+		case reflect.Float64:
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return fmt.Errorf("%s must be a number: %w", name, err)
+			}
+			field.SetFloat(f)
+		case reflect.Bool:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("%s must be true or false: %w", name, err)
+			}
+			field.SetBool(b)
+		case reflect.Slice:
+			var items []string
+			for _, item := range strings.Split(value, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					items = append(items, item)
+				}
+			}
+			field.Set(reflect.ValueOf(items))
+		default:
+			return fmt.Errorf("%s can't be set from the environment", name)
+		}
+	}
+	return nil
+}
+
+// LoadSecrets reads the secrets that are configured as files instead of being
+// written into the configuration itself.
+func (c *Configuration) LoadSecrets() error {
+	if err := loadFile(&c.Password, c.PasswordFile, "password"); err != nil {
+		return err
+	}
+	if err := loadFile(&c.AccessToken, c.AccessTokenFile, "access_token"); err != nil {
+		return err
+	}
+	if err := loadFile(&c.PickleKey, c.PickleKeyFile, "pickle_key"); err != nil {
+		return err
+	}
+	if err := loadFile(&c.RecoveryKey, c.RecoveryKeyFile, "recovery_key"); err != nil {
+		return err
+	}
+	for i := range c.Accounts {
+		account := &c.Accounts[i]
+		prefix := fmt.Sprintf("accounts[%d].", i)
+		for _, setting := range []struct {
+			value *string
+			file  string
+			name  string
+		}{
+			{&account.Password, account.PasswordFile, "password"},
+			{&account.AccessToken, account.AccessTokenFile, "access_token"},
+			{&account.RecoveryKey, account.RecoveryKeyFile, "recovery_key"},
+			{&account.Persona, account.PersonaFile, "persona"},
+		} {
+			if err := loadFile(setting.value, setting.file, prefix+setting.name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// loadFile reads the setting called name from a file, if one is configured
+// with name_file. Only one of the two can be set.
+func loadFile(value *string, path, name string) error {
+	if path == "" {
+		return nil
+	}
+	if *value != "" {
+		return fmt.Errorf("only one of %s and %s_file can be set", name, name)
+	}
+	data, err := readSecretFile(path)
+	if err != nil {
+		return fmt.Errorf("couldn't read %s_file: %w", name, err)
+	}
+	*value = data
+	return nil
+}
+
+// readSecretFile returns the contents of a file holding a secret, without the
+// trailing newline editors like to add.
+func readSecretFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// restartOnlySettings are the settings that are only read at startup, keyed
+// by their yaml name. A reload keeps their current values.
+var restartOnlySettings = map[string]bool{
+	"username":             true,
+	"password":             true,
+	"password_file":        true,
+	"access_token":         true,
+	"access_token_file":    true,
+	"pickle_key":           true,
+	"pickle_key_file":      true,
+	"recovery_key":         true,
+	"recovery_key_file":    true,
+	"homeserver":           true,
+	"database_uri":         true,
+	"metrics_listen":       true,
+	"log_format":           true,
+	"txt2txt_history_file": true,
+}
+
+// LoadConfiguration reads, parses and validates the configuration file at path.
+func LoadConfiguration(path string) (*Configuration, error) {
+	configBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &Configuration{}
+	if err := config.Parse(configBytes); err != nil {
+		return nil, fmt.Errorf("couldn't parse %s: %w", path, err)
+	}
+	if err := config.ApplyEnvironment(os.LookupEnv); err != nil {
+		return nil, err
+	}
+	if err := config.LoadSecrets(); err != nil {
+		return nil, err
+	}
+	config.SetDefaults()
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// Validate checks the settings and reports every problem it finds at once.
+func (c *Configuration) Validate() error {
+	var errs []error
+
+	if len(c.Accounts) == 0 {
+		errs = append(errs, c.AccountConfigs()[0].validate("")...)
+	} else {
+		if c.Username != "" || c.Homeserver != "" || c.Password != "" || c.AccessToken != "" || c.RecoveryKey != "" {
+			errs = append(errs, errors.New("with accounts, the username, homeserver, credentials and recovery key are set per account"))
+		}
+		usernames := make(map[string]bool)
+		historyFiles := make(map[string]bool)
+		for i, account := range c.Accounts {
+			prefix := fmt.Sprintf("accounts[%d].", i)
+			errs = append(errs, account.validate(prefix)...)
+			if usernames[account.Username] {
+				errs = append(errs, fmt.Errorf("%susername: %s is configured twice", prefix, account.Username))
+			}
+			usernames[account.Username] = true
+			if historyFiles[account.Txt2TxtHistoryFile] {
+				errs = append(errs, fmt.Errorf("%stxt2txt_history_file: %s is used by another account", prefix, account.Txt2TxtHistoryFile))
+			}
+			historyFiles[account.Txt2TxtHistoryFile] = true
+		}
+	}
+
+	if c.Txt2ImgAPIURL != "" {
+		if err := validateURL(c.Txt2ImgAPIURL, "http", "https"); err != nil {
+			errs = append(errs, fmt.Errorf("txt2img_api_url: %w", err))
+		}
+	}
+	if c.Txt2TxtAPIURL != "" {
+		if err := validateURL(c.Txt2TxtAPIURL, "http", "https", "ws", "wss"); err != nil {
+			errs = append(errs, fmt.Errorf("txt2txt_api_url: %w", err))
+		}
+	}
+
+	if c.DebugRoom != "" && !strings.HasPrefix(c.DebugRoom, "!") {
+		errs = append(errs, fmt.Errorf("debug_room %q is not a room ID like !abc:example.com", c.DebugRoom))
+	}
+	for _, admin := range c.Admins {
+		if _, _, err := mid.UserID(admin).Parse(); err != nil {
+			errs = append(errs, fmt.Errorf("admins: %q is not a valid Matrix user ID", admin))
+		}
+	}
+
+	if c.DecryptionTimeout < 0 {
+		errs = append(errs, errors.New("decryption_timeout can't be negative"))
+	}
+	if c.ShutdownTimeout < 0 {
+		errs = append(errs, errors.New("shutdown_timeout can't be negative"))
+	}
+	if c.HealthMaxSyncAge < 0 {
+		errs = append(errs, errors.New("health_max_sync_age can't be negative"))
+	}
+	if _, err := zerolog.ParseLevel(c.LogLevel); err != nil {
+		errs = append(errs, fmt.Errorf("log_level: %w", err))
+	}
+	if c.LogFormat != logFormatJSON && c.LogFormat != logFormatConsole {
+		errs = append(errs, fmt.Errorf("log_format must be %s or %s", logFormatJSON, logFormatConsole))
+	}
+
+	for scope, settings := range []LimitSettings{c.Limits.User, c.Limits.Room} {
+		if settings.Burst < 0 || settings.PerMinute < 0 || settings.DailyImages < 0 || settings.DailyTokens < 0 {
+			errs = append(errs, fmt.Errorf("limits.%s: limits can't be negative", []string{"user", "room"}[scope]))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// validate checks the settings of an account. The prefix tells accounts
+// apart in the errors.
+func (a *AccountConfig) validate(prefix string) []error {
+	var errs []error
+	if a.Username == "" {
+		errs = append(errs, fmt.Errorf("%susername is required", prefix))
+	} else if _, _, err := mid.UserID(a.Username).Parse(); err != nil {
+		errs = append(errs, fmt.Errorf("%susername %q is not a valid Matrix user ID like @bot:example.com", prefix, a.Username))
+	}
+	if a.Password == "" && a.AccessToken == "" {
+		errs = append(errs, fmt.Errorf("one of %[1]spassword, %[1]spassword_file, %[1]saccess_token or %[1]saccess_token_file is required", prefix))
+	}
+	if a.Homeserver == "" {
+		errs = append(errs, fmt.Errorf("%shomeserver is required", prefix))
+	} else if err := validateURL(a.Homeserver, "http", "https"); err != nil {
+		errs = append(errs, fmt.Errorf("%shomeserver: %w", prefix, err))
+	}
+	for _, feature := range a.Features {
+		if feature != featureChat && feature != featureImages {
+			errs = append(errs, fmt.Errorf("%sfeatures: %q isn't one of %s or %s", prefix, feature, featureChat, featureImages))
+		}
+	}
+	return errs
+}
+
+func validateURL(value string, schemes ...string) error {
+	u, err := url.Parse(value)
+	if err != nil {
+		return fmt.Errorf("%q is not a valid URL: %w", value, err)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("%q is missing a host", value)
+	}
+	for _, scheme := range schemes {
+		if u.Scheme == scheme {
+			return nil
+		}
+	}
+	return fmt.Errorf("%q must start with one of %s://", value, strings.Join(schemes, "://, "))
+}
+
+// ReloadResult lists the yaml names of the settings that changed in a reload.
+type ReloadResult struct {
+	Applied     []string
+	NeedRestart []string
+}
+
+func (r ReloadResult) String() string {
+	if len(r.Applied) == 0 && len(r.NeedRestart) == 0 {
+		return "configuration reloaded, nothing changed"
+	}
+
+	var sb strings.Builder
+	sb.WriteString("configuration reloaded")
+	if len(r.Applied) > 0 {
+		fmt.Fprintf(&sb, "\n\napplied: %s", strings.Join(r.Applied, ", "))
+	}
+	if len(r.NeedRestart) > 0 {
+		fmt.Fprintf(&sb, "\n\nneeds a restart: %s", strings.Join(r.NeedRestart, ", "))
+	}
+	return sb.String()
+}
+
+// reloadConfiguration re-reads the configuration file the bot was started
+// with. If it is valid, it atomically replaces the current configuration,
+// except for the settings that can only change with a restart.
+func reloadConfiguration() (ReloadResult, error) {
+	var result ReloadResult
+	config, err := LoadConfiguration(Bot.configPath)
+	if err != nil {
+		return result, err
+	}
+
+	current := Bot.Config()
+	newValue := reflect.ValueOf(config).Elem()
+	currentValue := reflect.ValueOf(current).Elem()
+	for i := 0; i < newValue.NumField(); i++ {
+		name := yamlName(newValue.Type().Field(i))
+		if reflect.DeepEqual(newValue.Field(i).Interface(), currentValue.Field(i).Interface()) {
+			continue
+		}
+		if name == "accounts" && !sameLogins(config.AccountConfigs(), current.AccountConfigs()) {
+			// Accounts can't be added, removed or logged in differently
+			// without a restart, but their other settings can change
+			result.NeedRestart = append(result.NeedRestart, name)
+			newValue.Field(i).Set(currentValue.Field(i))
+		} else if restartOnlySettings[name] {
+			result.NeedRestart = append(result.NeedRestart, name)
+			newValue.Field(i).Set(currentValue.Field(i))
+		} else {
+			result.Applied = append(result.Applied, name)
+		}
+	}
+
+	Bot.configuration.Store(config)
+	return result, nil
+}
+
+func sameLogins(a, b []AccountConfig) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].sameLogin(&b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func yamlName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+	if name == "" {
+		return strings.ToLower(field.Name)
+	}
+	return name
+}
+
+func (c *Configuration) IsAdmin(userID mid.UserID) bool {
+	for _, admin := range c.Admins {
+		if admin == userID.String() {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReloadConfiguration(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	write := func(data string) {
+		if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(`
+username: "@bot:example.com"
+password: "hunter2"
+homeserver: "https://example.com"
+txt2img_api_url: "http://sd.example.com/sdapi/v1/txt2img"
+`)
+	config, err := LoadConfiguration(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Bot.configPath = path
+	Bot.configuration.Store(config)
+	defer Bot.configuration.Store(nil)
+
+	write(`
+username: "@other:example.com"
+password: "hunter2"
+homeserver: "https://example.com"
+txt2img_api_url: "http://sd2.example.com/sdapi/v1/txt2img"
+display_name: "imagegen bot"
+`)
+	result, err := reloadConfiguration()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := ReloadResult{
+		Applied:     []string{"txt2img_api_url", "display_name"},
+		NeedRestart: []string{"username"},
+	}
+	if !reflect.DeepEqual(result, want) {
+		t.Errorf("reloadConfiguration() = %+v, want %+v", result, want)
+	}
+	if got := Bot.Config().Username; got != "@bot:example.com" {
+		t.Errorf("username changed to %s without a restart", got)
+	}
+	if got := Bot.Config().Txt2ImgAPIURL; got != "http://sd2.example.com/sdapi/v1/txt2img" {
+		t.Errorf("txt2img_api_url wasn't applied, got %s", got)
+	}
+
+	write(`username: "not a user id"`)
+	if _, err := reloadConfiguration(); err == nil {
+		t.Error("reloading an invalid configuration succeeded")
+	}
+	if got := Bot.Config().DisplayName; got != "imagegen bot" {
+		t.Errorf("an invalid configuration replaced the current one")
+	}
+}
+
+func TestReloadAccounts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	load := func(persona, homeserver string) (ReloadResult, error) {
+		data := "accounts:\n  - {username: \"@bot:example.com\", password: x, homeserver: " + homeserver + ", persona: " + persona + "}"
+		if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return reloadConfiguration()
+	}
+
+	config := &Configuration{Accounts: []AccountConfig{{Username: "@bot:example.com", Password: "x", Homeserver: "https://example.com", Persona: "Be nice."}}}
+	config.SetDefaults()
+	Bot.configPath = path
+	Bot.configuration.Store(config)
+	defer Bot.configuration.Store(nil)
+
+	result, err := load("Be brief.", "https://example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(result.Applied, []string{"accounts"}) || Bot.Config().Accounts[0].Persona != "Be brief." {
+		t.Errorf("expected the persona to be applied, got %+v", result)
+	}
+
+	result, err = load("Be funny.", "https://example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(result.NeedRestart, []string{"accounts"}) || Bot.Config().Accounts[0].Persona != "Be brief." {
+		t.Errorf("expected the accounts to need a restart, got %+v", result)
+	}
+}
+
+func TestLoadConfiguration(t *testing.T) {
+	dir := t.TempDir()
+	passwordFile := filepath.Join(dir, "password")
+	if err := os.WriteFile(passwordFile, []byte("hunter2\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		config  string
+		env     map[string]string
+		want    func(*Configuration) bool
+		wantErr bool
+	}{
+		{
+			name:   "defaults",
+			config: "username: \"@bot:example.com\"\npassword: x\nhomeserver: https://example.com",
+			want: func(c *Configuration) bool {
+				return c.DisplayName == "bot" && c.Txt2TxtHistoryFile == "ai_history.json"
+			},
+		},
+		{
+			name:    "unknown key",
+			config:  "username: \"@bot:example.com\"\npassword: x\nhomeserver: https://example.com\nhome_server: typo",
+			wantErr: true,
+		},
+		{
+			name:    "invalid URL and user ID",
+			config:  "username: bot\npassword: x\nhomeserver: example.com",
+			wantErr: true,
+		},
+		{
+			name:   "password file",
+			config: "username: \"@bot:example.com\"\npassword_file: " + passwordFile + "\nhomeserver: https://example.com",
+			want:   func(c *Configuration) bool { return c.Password == "hunter2" },
+		},
+		{
+			name:   "environment overrides",
+			config: "username: \"@bot:example.com\"\nhomeserver: https://example.com",
+			env: map[string]string{
+				"BOT_PASSWORD":          "from env",
+				"BOT_LIMITS_USER_BURST": "3",
+				"BOT_ADMINS":            "@a:example.com, @b:example.com",
+			},
+			want: func(c *Configuration) bool {
+				return c.Password == "from env" && c.Limits.User.Burst == 3 && len(c.Admins) == 2
+			},
+		},
+		{
+			name: "accounts",
+			config: "accounts:\n" +
+				"  - {username: \"@chat:example.com\", password: x, homeserver: https://example.com, features: [chat]}\n" +
+				"  - {username: \"@images:example.org\", password: y, homeserver: https://example.org, persona: Be brief.}",
+			want: func(c *Configuration) bool {
+				accounts := c.AccountConfigs()
+				return len(accounts) == 2 && accounts[0].DisplayName == "bot" &&
+					accounts[0].Txt2TxtHistoryFile == "ai_history-chat.json" &&
+					!accounts[0].HasFeature(featureImages) && accounts[1].HasFeature(featureImages) &&
+					c.Account("@images:example.org").Persona == "Be brief."
+			},
+		},
+		{
+			name: "accounts and a top-level username",
+			config: "username: \"@bot:example.com\"\naccounts:\n" +
+				"  - {username: \"@chat:example.com\", password: x, homeserver: https://example.com}",
+			wantErr: true,
+		},
+		{
+			name: "duplicate accounts",
+			config: "accounts:\n" +
+				"  - {username: \"@chat:example.com\", password: x, homeserver: https://example.com}\n" +
+				"  - {username: \"@chat:example.com\", password: x, homeserver: https://example.com}",
+			wantErr: true,
+		},
+		{
+			name:    "unknown feature",
+			config:  "accounts:\n  - {username: \"@chat:example.com\", password: x, homeserver: https://example.com, features: [music]}",
+			wantErr: true,
+		},
+		{
+			name:    "invalid environment override",
+			config:  "username: \"@bot:example.com\"\npassword: x\nhomeserver: https://example.com",
+			env:     map[string]string{"BOT_LIMITS_ROOM_PER_MINUTE": "lots"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+			path := filepath.Join(dir, "config.yaml")
+			if err := os.WriteFile(path, []byte(tt.config), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			config, err := LoadConfiguration(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadConfiguration() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && !tt.want(config) {
+				t.Errorf("LoadConfiguration() = %+v", config)
+			}
+		})
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"maunium.net/go/mautrix"
+	mcrypto "maunium.net/go/mautrix/crypto"
+	"maunium.net/go/mautrix/crypto/ssss"
+	mevent "maunium.net/go/mautrix/event"
+	mid "maunium.net/go/mautrix/id"
+)
+
+// cryptoHelper lets the mautrix client and the verification helper use the
+// bot's OlmMachine.
+type cryptoHelper struct {
+	mach *mcrypto.OlmMachine
+}
+
+var _ mautrix.CryptoHelper = (*cryptoHelper)(nil)
+
+// Encrypt encrypts an event for a room, sharing a new Megolm session with the
+// room members first if needed.
+func (helper *cryptoHelper) Encrypt(ctx context.Context, roomID mid.RoomID, evtType mevent.Type, content any) (*mevent.EncryptedEventContent, error) {
+	encrypted, err := helper.mach.EncryptMegolmEvent(ctx, roomID, evtType, content)
+
+	// These three errors mean we have to make a new Megolm session
+	if err == mcrypto.SessionExpired || err == mcrypto.SessionNotShared || err == mcrypto.NoGroupSession {
+		members, err := Bot.stateStore.GetRoomJoinedOrInvitedMembers(ctx, roomID)
+		if err != nil {
+			return nil, err
+		}
+		err = helper.mach.ShareGroupSession(ctx, roomID, members)
+		if err != nil {
+			log.Error().Err(err).Msgf("Failed to share group session to %s", roomID)
+			return nil, err
+		}
+
+		encrypted, err = helper.mach.EncryptMegolmEvent(ctx, roomID, evtType, content)
+	}
+	return encrypted, err
+}
+
+func (helper *cryptoHelper) Decrypt(ctx context.Context, event *mevent.Event) (*mevent.Event, error) {
+	return helper.mach.DecryptMegolmEvent(ctx, event)
+}
+
+func (helper *cryptoHelper) WaitForSession(ctx context.Context, roomID mid.RoomID, senderKey mid.SenderKey, sessionID mid.SessionID, timeout time.Duration) bool {
+	return helper.mach.WaitForSession(ctx, roomID, senderKey, sessionID, timeout)
+}
+
+// RequestSession asks the sender's devices and our own other devices for a
+// session. Without a device ID, every device of the sender is asked.
+func (helper *cryptoHelper) RequestSession(ctx context.Context, roomID mid.RoomID, senderKey mid.SenderKey, sessionID mid.SessionID, userID mid.UserID, deviceID mid.DeviceID) {
+	if deviceID == "" {
+		deviceID = "*"
+	}
+	err := helper.mach.SendRoomKeyRequest(ctx, roomID, senderKey, sessionID, "", map[mid.UserID][]mid.DeviceID{
+		userID:                    {deviceID},
+		helper.mach.Client.UserID: {"*"},
+	})
+	if err != nil {
+		log.Warn().Err(err).Msgf("Failed to request session %s in %s", sessionID, roomID)
+	}
+}
+
+func (helper *cryptoHelper) Init(context.Context) error {
+	return nil
+}
+
+// setupCrossSigning makes sure the bot has cross-signing keys and signs its
+// own device with them, so that other users see it as verified. It returns
+// the secret storage key, or nil if secret storage couldn't be unlocked.
+//
+// If the account has no cross-signing keys yet, they are generated and stored
+// in secret storage under a new recovery key, which is logged once. On later
+// starts, the recovery key from the configuration unlocks them again.
+func setupCrossSigning(ctx context.Context, mach *mcrypto.OlmMachine, config *AccountConfig) (*ssss.Key, error) {
+	ownUserID := mach.Client.UserID
+	if _, err := mach.FetchKeys(ctx, []mid.UserID{ownUserID}, true); err != nil {
+		return nil, fmt.Errorf("couldn't fetch our own keys: %w", err)
+	}
+
+	var key *ssss.Key
+	if pubkeys := mach.GetOwnCrossSigningPublicKeys(ctx); pubkeys == nil || pubkeys.MasterKey == "" {
+		if config.Password == "" {
+			log.Warn().Msg("The account has no cross-signing keys, and they can only be created with a password")
+			return nil, nil
+		}
+
+		recoveryKey, _, err := mach.GenerateAndUploadCrossSigningKeysWithPassword(ctx, config.Password, "")
+		if err != nil {
+			return nil, fmt.Errorf("couldn't create cross-signing keys: %w", err)
+		}
+		log.Warn().Msgf("Created cross-signing keys. Put this recovery key into recovery_key in the configuration, "+
+			"it won't be shown again: %s", recoveryKey)
+
+		if key, err = unlockSecretStorage(ctx, mach, recoveryKey); err != nil {
+			return nil, err
+		}
+	} else {
+		if config.RecoveryKey == "" {
+			log.Warn().Msg("The account has cross-signing keys, but no recovery_key is configured to unlock them")
+			return nil, nil
+		}
+
+		var err error
+		if key, err = unlockSecretStorage(ctx, mach, config.RecoveryKey); err != nil {
+			return nil, err
+		}
+		if err := mach.FetchCrossSigningKeysFromSSSS(ctx, key); err != nil {
+			return nil, fmt.Errorf("couldn't fetch the cross-signing keys from secret storage: %w", err)
+		}
+	}
+
+	if err := mach.SignOwnMasterKey(ctx); err != nil {
+		return nil, fmt.Errorf("couldn't sign our master key: %w", err)
+	}
+	if err := mach.SignOwnDevice(ctx, mach.OwnIdentity()); err != nil {
+		return nil, fmt.Errorf("couldn't sign our device: %w", err)
+	}
+	log.Info().Msgf("Signed device %s with our cross-signing keys", mach.Client.DeviceID)
+	return key, nil
+}
+
+// unlockSecretStorage turns a recovery key into the default secret storage key.
+func unlockSecretStorage(ctx context.Context, mach *mcrypto.OlmMachine, recoveryKey string) (*ssss.Key, error) {
+	_, keyData, err := mach.SSSS.GetDefaultKeyData(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get the secret storage key: %w", err)
+	}
+	key, err := keyData.VerifyRecoveryKey(recoveryKey)
+	if err != nil {
+		return nil, fmt.Errorf("the recovery key doesn't unlock secret storage: %w", err)
+	}
+	return key, nil
+}
+
+// sasTimeout is how long a SAS verification waits for an admin to compare
+// the emojis before it is cancelled.
+const sasTimeout = 10 * time.Minute
+
+// errUnknownVerification means no SAS verification with that transaction ID is
+// waiting for an admin.
+var errUnknownVerification = errors.New("no verification with that ID is waiting")
+
+// sasVerifier confirms or cancels SAS verifications. It's implemented by
+// verificationhelper.VerificationHelper.
+type sasVerifier interface {
+	AcceptVerification(ctx context.Context, txnID mid.VerificationTransactionID) error
+	ConfirmSAS(ctx context.Context, txnID mid.VerificationTransactionID) error
+	CancelVerification(ctx context.Context, txnID mid.VerificationTransactionID, code mevent.VerificationCancelCode, reason string) error
+}
+
+// verificationCallbacks answers SAS verification requests from the admins.
+// The bot can't compare emojis, so it posts them to the debug room and waits
+// for an admin to send !verify or !reject.
+type verificationCallbacks struct {
+	helper  sasVerifier
+	timeout time.Duration
+}
+
+func (v *verificationCallbacks) VerificationRequested(ctx context.Context, txnID mid.VerificationTransactionID, from mid.UserID) {
+	if !Bot.Config().IsAdmin(from) {
+		log.Info().Msgf("Rejecting verification request %s from %s, who isn't an admin", txnID, from)
+		go v.helper.CancelVerification(ctx, txnID, mevent.VerificationCancelCodeUser, "Only admins can verify this bot")
+		return
+	}
+
+	log.Info().Msgf("Accepting verification request %s from %s", txnID, from)
+	go func() {
+		if err := v.helper.AcceptVerification(ctx, txnID); err != nil {
+			log.Error().Err(err).Msgf("Failed to accept verification request %s", txnID)
+		}
+	}()
+}
+
+func (v *verificationCallbacks) ShowSAS(_ context.Context, txnID mid.VerificationTransactionID, emojis []rune, decimals []int) {
+	log.Info().Msgf("SAS for verification %s: %s %v", txnID, string(emojis), decimals)
+	pendingSAS.park(txnID, v.helper, v.timeout)
+	notifyDebugRoom(fmt.Sprintf("verification %s shows %s %v, send `!verify %s` if your client shows the same or `!reject %s`",
+		txnID, string(emojis), decimals, txnID, txnID))
+}
+
+func (v *verificationCallbacks) VerificationCancelled(_ context.Context, txnID mid.VerificationTransactionID, code mevent.VerificationCancelCode, reason string) {
+	pendingSAS.take(txnID)
+	log.Info().Msgf("Verification %s was cancelled: %s (%s)", txnID, reason, code)
+	notifyDebugRoom(fmt.Sprintf("verification %s was cancelled: %s", txnID, reason))
+}
+
+func (v *verificationCallbacks) VerificationDone(_ context.Context, txnID mid.VerificationTransactionID) {
+	pendingSAS.take(txnID)
+	log.Info().Msgf("Verification %s is done", txnID)
+	notifyDebugRoom(fmt.Sprintf("verification %s is done", txnID))
+}
+
+// sasWaiting is a SAS verification whose emojis an admin has to compare.
+type sasWaiting struct {
+	verifier sasVerifier
+	timer    *time.Timer
+}
+
+// sasRegistry holds the SAS verifications of every account that wait for an
+// admin, by transaction ID.
+type sasRegistry struct {
+	sync.Mutex
+	waiting map[mid.VerificationTransactionID]*sasWaiting
+}
+
+var pendingSAS = &sasRegistry{waiting: make(map[mid.VerificationTransactionID]*sasWaiting)}
+
+// park keeps a verification until an admin confirms or rejects it, and cancels
+// it after timeout.
+func (r *sasRegistry) park(txnID mid.VerificationTransactionID, verifier sasVerifier, timeout time.Duration) {
+	r.Lock()
+	defer r.Unlock()
+	r.waiting[txnID] = &sasWaiting{
+		verifier: verifier,
+		timer: time.AfterFunc(timeout, func() {
+			err := r.reject(context.Background(), txnID, mevent.VerificationCancelCodeTimeout, "Nobody compared the emojis in time")
+			if err != nil && !errors.Is(err, errUnknownVerification) {
+				log.Error().Err(err).Msgf("Failed to cancel verification %s after it timed out", txnID)
+			}
+		}),
+	}
+}
+
+// take removes a waiting verification, if there is one.
+func (r *sasRegistry) take(txnID mid.VerificationTransactionID) *sasWaiting {
+	r.Lock()
+	defer r.Unlock()
+	waiting := r.waiting[txnID]
+	if waiting != nil {
+		waiting.timer.Stop()
+		delete(r.waiting, txnID)
+	}
+	return waiting
+}
+
+// confirm tells the other device that the emojis match.
+func (r *sasRegistry) confirm(ctx context.Context, txnID mid.VerificationTransactionID) error {
+	waiting := r.take(txnID)
+	if waiting == nil {
+		return errUnknownVerification
+	}
+	return waiting.verifier.ConfirmSAS(ctx, txnID)
+}
+
+// reject cancels a waiting verification.
+func (r *sasRegistry) reject(ctx context.Context, txnID mid.VerificationTransactionID, code mevent.VerificationCancelCode, reason string) error {
+	// The helper calls VerificationCancelled, which takes the lock again
+	waiting := r.take(txnID)
+	if waiting == nil {
+		return errUnknownVerification
+	}
+	return waiting.verifier.CancelVerification(ctx, txnID, code, reason)
+}
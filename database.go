@@ -0,0 +1,21 @@
+package main
+
+import (
+	"database/sql"
+	"strings"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+	"go.mau.fi/util/dbutil"
+)
+
+// openDatabase opens the database at uri. postgres:// and postgresql:// URIs
+// select PostgreSQL, anything else is taken as an SQLite file name or DSN.
+func openDatabase(uri string) (*sql.DB, dbutil.Dialect, error) {
+	dialect := dbutil.SQLite
+	if strings.HasPrefix(uri, "postgres://") || strings.HasPrefix(uri, "postgresql://") {
+		dialect = dbutil.Postgres
+	}
+	db, err := sql.Open(dialect.String(), uri)
+	return db, dialect, err
+}
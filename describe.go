@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"strings"
+
+	"github.com/rs/zerolog"
+	mevent "maunium.net/go/mautrix/event"
+)
+
+const describeUsage = "reply to an image with `!describe` to caption it, or `!describe model:deepdanbooru` for tags. " +
+	"`!remix <prompt>` generates a new image from them and your prompt"
+
+// interrogate_request is a request to the interrogate API to caption an image.
+type interrogate_request struct {
+	Image string `json:"image"`
+	Model string `json:"model"`
+}
+
+type interrogate_response struct {
+	Caption string `json:"caption"`
+}
+
+// ParseDescribeOptions parses the model setting of !describe and !remix, and
+// returns the rest of the options.
+func ParseDescribeOptions(options string) (interrogate_request, string) {
+	request := interrogate_request{Model: "clip"}
+	options = parseSettings(options, func(setting, value string) bool {
+		return handleDescribeSetting(&request, setting, value)
+	})
+	return request, strings.TrimSpace(options)
+}
+
+func handleDescribeSetting(request *interrogate_request, setting, value string) bool {
+	supportedModels := map[string]string{
+		"clip":         "clip",
+		"deepdanbooru": "deepdanbooru",
+		"danbooru":     "deepdanbooru",
+	}
+
+	switch setting {
+	case "model":
+		if model, ok := supportedModels[value]; ok {
+			request.Model = model
+		}
+		return true
+	}
+	return false
+}
+
+// remixPrompt merges the caption of an image with the extra prompt of !remix
+// and parses the result. Settings in the caption are dropped, only the extra
+// prompt can change the job.
+func remixPrompt(caption, extra string) txt2img_request {
+	caption = parseSettings(caption, func(setting, value string) bool {
+		return handleSetting(&txt2img_request{}, &map[string]bool{}, setting, value)
+	})
+	positive, negative := splitPrompt(extra)
+	prompt := strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(caption), ","))
+	if positive != "" {
+		prompt += ", " + positive
+	}
+	if negative != "" {
+		prompt += " ### " + negative
+	}
+	return ParsePromptForTxt2Img(prompt)
+}
+
+func (a automatic1111) Interrogate(ctx context.Context, request interrogate_request) (string, error) {
+	var res interrogate_response
+	if err := a.post(ctx, sdAPIURL("interrogate"), request, &res); err != nil {
+		return "", err
+	}
+	if res.Caption == "" {
+		return "", errors.New("No caption in response")
+	}
+	return res.Caption, nil
+}
+
+// handleDescribe replies with the caption or the tags of the image that the
+// message replies to.
+func (h *Handler) handleDescribe(ctx context.Context, event *mevent.Event, content *mevent.MessageEventContent, options string) {
+	request, _ := ParseDescribeOptions(options)
+
+	_, data, ok := h.repliedImage(ctx, event, content, describeUsage)
+	if !ok {
+		return
+	}
+	request.Image = base64.StdEncoding.EncodeToString(data)
+
+	if _, ok := h.allowedByLimiter(ctx, event, Cost{}); !ok {
+		return
+	}
+	job := h.StartJob(ctx, event, jobKindInterrogate, h.config().Txt2ImgAPIURL)
+	job.Model = request.Model
+	caption, err := h.images.Interrogate(job.Context(), request)
+	if err != nil {
+		if !job.Interrupted() {
+			h.sendReply(ctx, event, "i'm sorry dave, i'm afraid i can't do that")
+		}
+		h.sendReaction(ctx, event, "❌")
+	} else {
+		h.sendReply(ctx, event, caption)
+	}
+	job.Finish(Usage{}, 0, err)
+}
+
+// handleRemix generates a new image from the caption or the tags of the image
+// that the message replies to, merged with the prompt of the message.
+func (h *Handler) handleRemix(ctx context.Context, event *mevent.Event, content *mevent.MessageEventContent, options string) {
+	logger := zerolog.Ctx(ctx)
+	interrogation, extra := ParseDescribeOptions(options)
+
+	_, data, ok := h.repliedImage(ctx, event, content, describeUsage)
+	if !ok {
+		return
+	}
+	interrogation.Image = base64.StdEncoding.EncodeToString(data)
+
+	// The settings are known before the caption, and the caption is made in
+	// the same job as the image
+	var request txt2img_request
+	h.generateImage(ctx, event, jobKindTxt2Img, imageCount(remixPrompt("", extra)), func(ctx context.Context) ([]byte, txt2img_info, error) {
+		caption, err := h.images.Interrogate(ctx, interrogation)
+		if err != nil {
+			return nil, txt2img_info{}, err
+		}
+		request = remixPrompt(caption, extra)
+		logger.Debug().Msgf("Remixing with %s", redact(request.Prompt))
+		return h.images.GenerateImage(ctx, request)
+	}, func(data []byte, _ txt2img_info) {
+		h.sendCaptionedImage(ctx, event, "image.png", request.Prompt, data)
+	})
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"strconv"
+
+	"github.com/rs/zerolog"
+	mevent "maunium.net/go/mautrix/event"
+)
+
+const extendUsage = "reply to an image with `!extend left:256 right:256 <prompt>` to extend it. " +
+	"the sides are `left`, `right`, `top` and `bottom`"
+
+// padding is how far to extend each side of an image, in pixels.
+type padding struct {
+	left, right, top, bottom int
+}
+
+// ParsePromptForExtend parses a prompt with the padding of each side and the
+// img2img settings.
+func ParsePromptForExtend(prompt string) (img2img_request, padding) {
+	var pad padding
+	prompt = parseSettings(prompt, func(setting, value string) bool {
+		return handlePaddingSetting(&pad, setting, value)
+	})
+	request, _ := ParsePromptForImg2Img(prompt)
+	return request, pad
+}
+
+func handlePaddingSetting(pad *padding, setting, value string) bool {
+	var side *int
+	switch setting {
+	case "left":
+		side = &pad.left
+	case "right":
+		side = &pad.right
+	case "top":
+		side = &pad.top
+	case "bottom":
+		side = &pad.bottom
+	default:
+		return false
+	}
+	if v, err := strconv.ParseInt(value, 10, 32); err == nil {
+		*side = clamp((int(v)+8-1)&-8, 0, img2imgMaxSize)
+	}
+	return true
+}
+
+// extendMaxSize is the largest width or height of an image that can be
+// extended. The padded canvas is scaled down to img2imgMaxSize anyway, this
+// only keeps huge images from being decoded.
+const extendMaxSize = 4096
+
+// padImage puts an image on a canvas that is larger by the padding. The new
+// area is filled by stretching the edges of the image, which gives the model
+// the colors to continue.
+func padImage(src image.Image, pad padding) *image.RGBA {
+	bounds := src.Bounds()
+	canvas := image.NewRGBA(image.Rect(0, 0, bounds.Dx()+pad.left+pad.right, bounds.Dy()+pad.top+pad.bottom))
+	original := image.Rect(pad.left, pad.top, pad.left+bounds.Dx(), pad.top+bounds.Dy())
+	draw.Draw(canvas, original, src, bounds.Min, draw.Src)
+
+	// The sides first, then the full rows above and below, which covers the
+	// corners
+	for y := original.Min.Y; y < original.Max.Y; y++ {
+		left := &image.Uniform{canvas.At(original.Min.X, y)}
+		draw.Draw(canvas, image.Rect(0, y, original.Min.X, y+1), left, image.Point{}, draw.Src)
+		right := &image.Uniform{canvas.At(original.Max.X-1, y)}
+		draw.Draw(canvas, image.Rect(original.Max.X, y, canvas.Rect.Max.X, y+1), right, image.Point{}, draw.Src)
+	}
+	for y := 0; y < original.Min.Y; y++ {
+		draw.Draw(canvas, image.Rect(0, y, canvas.Rect.Max.X, y+1), canvas, image.Pt(0, original.Min.Y), draw.Src)
+	}
+	for y := original.Max.Y; y < canvas.Rect.Max.Y; y++ {
+		draw.Draw(canvas, image.Rect(0, y, canvas.Rect.Max.X, y+1), canvas, image.Pt(0, original.Max.Y-1), draw.Src)
+	}
+	return canvas
+}
+
+// handleExtend pads the image that the message replies to and paints the new
+// area with img2img.
+func (h *Handler) handleExtend(ctx context.Context, event *mevent.Event, content *mevent.MessageEventContent, prompt string) {
+	logger := zerolog.Ctx(ctx)
+	request, pad := ParsePromptForExtend(prompt)
+
+	if pad == (padding{}) {
+		h.sendMarkdown(ctx, event, extendUsage)
+		return
+	}
+	_, data, ok := h.repliedImage(ctx, event, content, extendUsage)
+	if !ok {
+		return
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		h.sendReply(ctx, event, "Couldn't read the image you replied to")
+		return
+	}
+	if cfg.Width > extendMaxSize || cfg.Height > extendMaxSize {
+		h.sendReply(ctx, event, fmt.Sprintf("The image is too large to extend, it can be up to %dx%d", extendMaxSize, extendMaxSize))
+		return
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		h.sendReply(ctx, event, "Couldn't read the image you replied to")
+		return
+	}
+
+	canvas := padImage(src, pad)
+	var padded bytes.Buffer
+	if err := png.Encode(&padded, canvas); err != nil {
+		logger.Error().Err(err).Msg("Failed to encode the padded image")
+		return
+	}
+	// The mask covers the original image and is inverted, so that only the
+	// padding is painted
+	original := image.Rect(pad.left, pad.top, pad.left+src.Bounds().Dx(), pad.top+src.Bounds().Dy())
+	mask, err := rectMask(canvas.Rect.Dx(), canvas.Rect.Dy(), original)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to draw the mask")
+		return
+	}
+
+	// The size follows the canvas, the image would be stretched otherwise
+	request.Width, request.Height = fitSize(canvas.Rect.Dx(), canvas.Rect.Dy(), img2imgMaxSize)
+	request.InitImages = []string{base64.StdEncoding.EncodeToString(padded.Bytes())}
+	request.Mask = base64.StdEncoding.EncodeToString(mask)
+	request.InpaintingMaskInvert = 1
+
+	h.generateImage(ctx, event, jobKindImg2Img, imageCount(request.txt2img_request), func(ctx context.Context) ([]byte, txt2img_info, error) {
+		return h.images.EditImage(ctx, request)
+	}, func(data []byte, info txt2img_info) {
+		h.sendCaptionedImage(ctx, event, "image.png", fmt.Sprintf("seed: %d", info.Seed), data)
+	})
+}
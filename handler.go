@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bot/store"
+	"context"
+	"time"
+
+	"maunium.net/go/mautrix"
+	mevent "maunium.net/go/mautrix/event"
+	mid "maunium.net/go/mautrix/id"
+)
+
+// MatrixSender is what the handlers need from a Matrix account.
+type MatrixSender interface {
+	// SendMessage sends a message, encrypted if the room is encrypted.
+	SendMessage(ctx context.Context, roomID mid.RoomID, content *mevent.MessageEventContent) (mid.EventID, error)
+	SendReaction(ctx context.Context, roomID mid.RoomID, eventID mid.EventID, key string) error
+	UploadMedia(ctx context.Context, data []byte, contentType string) (mid.ContentURIString, error)
+	UserTyping(ctx context.Context, roomID mid.RoomID, typing bool, timeout time.Duration) error
+	StateEvent(ctx context.Context, roomID mid.RoomID, evtType mevent.Type, stateKey string, content any) error
+	JoinedRooms(ctx context.Context) ([]mid.RoomID, error)
+	LeaveRoom(ctx context.Context, roomID mid.RoomID) error
+	// GetEvent fetches an event of a room, decrypted if it's encrypted.
+	GetEvent(ctx context.Context, roomID mid.RoomID, eventID mid.EventID) (*mevent.Event, error)
+	DownloadMedia(ctx context.Context, uri mid.ContentURIString) ([]byte, error)
+	// MaxUploadSize returns the largest upload the homeserver accepts in
+	// bytes, or 0 if it doesn't say.
+	MaxUploadSize(ctx context.Context) (int64, error)
+}
+
+// ImageGenerator turns a txt2img request into an image, or edits, upscales
+// or captions an image.
+type ImageGenerator interface {
+	GenerateImage(ctx context.Context, request txt2img_request) ([]byte, txt2img_info, error)
+	EditImage(ctx context.Context, request img2img_request) ([]byte, txt2img_info, error)
+	UpscaleImage(ctx context.Context, request upscale_request) ([]byte, error)
+	Interrogate(ctx context.Context, request interrogate_request) (string, error)
+}
+
+// ChatBackend continues a conversation. It returns the conversation with the
+// reply appended.
+type ChatBackend interface {
+	Complete(ctx context.Context, request RequestData) ([]Message, Usage, error)
+}
+
+// Handler handles the messages to one bot account. Everything it talks to is
+// injected, so that commands can be tested with fakes.
+type Handler struct {
+	userID  mid.UserID
+	sender  MatrixSender
+	images  ImageGenerator
+	chat    ChatBackend
+	store   *store.StateStore
+	limiter *Limiter
+	txt2txt *Txt2txt
+	config  func() *Configuration
+
+	// Whether the account answers admin commands in the debug room, which
+	// only one account does
+	admin bool
+}
+
+// newHandler returns a handler that answers as the client's account, using
+// the bot's state and the backends from the configuration.
+func newHandler(client *mautrix.Client, txt2txt *Txt2txt) *Handler {
+	return &Handler{
+		userID:  client.UserID,
+		sender:  &matrixSender{client: client},
+		images:  automatic1111{},
+		chat:    openAIChat{},
+		store:   Bot.stateStore,
+		limiter: Bot.limiter,
+		txt2txt: txt2txt,
+		config:  Bot.Config,
+	}
+}
+
+// account returns the current configuration of the handler's account.
+func (h *Handler) account() *AccountConfig {
+	return h.config().Account(h.userID)
+}
@@ -0,0 +1,724 @@
+package main
+
+import (
+	"bot/store"
+	"bot/store/storetest"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	mevent "maunium.net/go/mautrix/event"
+	mid "maunium.net/go/mautrix/id"
+)
+
+// fakeSender records what a handler sends instead of talking to a homeserver.
+type fakeSender struct {
+	lock      sync.Mutex
+	messages  []*mevent.MessageEventContent
+	reactions []string
+	uploads   int
+	events    map[mid.EventID]*mevent.Event
+	media     map[mid.ContentURIString][]byte
+	maxUpload int64
+}
+
+func (s *fakeSender) SendMessage(_ context.Context, _ mid.RoomID, content *mevent.MessageEventContent) (mid.EventID, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.messages = append(s.messages, content)
+	return mid.EventID(fmt.Sprintf("$sent%d", len(s.messages))), nil
+}
+
+func (s *fakeSender) SendReaction(_ context.Context, _ mid.RoomID, _ mid.EventID, key string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.reactions = append(s.reactions, key)
+	return nil
+}
+
+func (s *fakeSender) UploadMedia(_ context.Context, data []byte, _ string) (mid.ContentURIString, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.uploads++
+	uri := mid.ContentURIString(fmt.Sprintf("mxc://example.com/%d", s.uploads))
+	s.media[uri] = data
+	return uri, nil
+}
+
+func (s *fakeSender) UserTyping(context.Context, mid.RoomID, bool, time.Duration) error {
+	return nil
+}
+
+func (s *fakeSender) StateEvent(context.Context, mid.RoomID, mevent.Type, string, any) error {
+	return errors.New("no state on the fake homeserver")
+}
+
+func (s *fakeSender) JoinedRooms(context.Context) ([]mid.RoomID, error) {
+	return nil, nil
+}
+
+func (s *fakeSender) LeaveRoom(context.Context, mid.RoomID) error {
+	return nil
+}
+
+func (s *fakeSender) GetEvent(_ context.Context, _ mid.RoomID, eventID mid.EventID) (*mevent.Event, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if event, ok := s.events[eventID]; ok {
+		return event, nil
+	}
+	return nil, errors.New("event not found")
+}
+
+func (s *fakeSender) DownloadMedia(_ context.Context, uri mid.ContentURIString) ([]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if data, ok := s.media[uri]; ok {
+		return data, nil
+	}
+	return nil, errors.New("media not found")
+}
+
+func (s *fakeSender) MaxUploadSize(context.Context) (int64, error) {
+	return s.maxUpload, nil
+}
+
+// postImage adds an image message, replying to replyTo if it's set, that
+// the handler can fetch.
+func (s *fakeSender) postImage(eventID, replyTo mid.EventID, data []byte) {
+	uri, _ := s.UploadMedia(context.Background(), data, "image/png")
+	content := &mevent.MessageEventContent{MsgType: mevent.MsgImage, Body: "image.png", URL: uri}
+	if replyTo != "" {
+		content.RelatesTo = (&mevent.RelatesTo{}).SetReplyTo(replyTo)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.events[eventID] = &mevent.Event{ID: eventID, Type: mevent.EventMessage, Content: mevent.Content{Parsed: content}}
+}
+
+type fakeImages struct {
+	requests []txt2img_request
+	edits    []img2img_request
+	upscales []upscale_request
+	captions []interrogate_request
+	caption  string
+	image    []byte
+	err      error
+}
+
+func (f *fakeImages) GenerateImage(_ context.Context, request txt2img_request) ([]byte, txt2img_info, error) {
+	f.requests = append(f.requests, request)
+	return f.image, txt2img_info{SDModelName: "fake"}, f.err
+}
+
+func (f *fakeImages) EditImage(_ context.Context, request img2img_request) ([]byte, txt2img_info, error) {
+	f.edits = append(f.edits, request)
+	return f.image, txt2img_info{Seed: 1234, SDModelName: "fake"}, f.err
+}
+
+func (f *fakeImages) UpscaleImage(_ context.Context, request upscale_request) ([]byte, error) {
+	f.upscales = append(f.upscales, request)
+	return f.image, f.err
+}
+
+func (f *fakeImages) Interrogate(_ context.Context, request interrogate_request) (string, error) {
+	f.captions = append(f.captions, request)
+	return f.caption, f.err
+}
+
+type fakeChat struct {
+	lock     sync.Mutex
+	requests []RequestData
+	reply    string
+	err      error
+}
+
+func (f *fakeChat) Complete(_ context.Context, request RequestData) ([]Message, Usage, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.requests = append(f.requests, request)
+	if f.err != nil {
+		return request.Messages, Usage{}, f.err
+	}
+	return append(request.Messages, Message{Role: "assistant", Content: f.reply}), Usage{TotalTokens: 10}, nil
+}
+
+// fakeVerifier records what happens to SAS verifications.
+type fakeVerifier struct {
+	lock      sync.Mutex
+	confirmed bool
+	cancelled mevent.VerificationCancelCode
+}
+
+func (f *fakeVerifier) AcceptVerification(context.Context, mid.VerificationTransactionID) error {
+	return nil
+}
+
+func (f *fakeVerifier) ConfirmSAS(context.Context, mid.VerificationTransactionID) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.confirmed = true
+	return nil
+}
+
+func (f *fakeVerifier) CancelVerification(_ context.Context, _ mid.VerificationTransactionID, code mevent.VerificationCancelCode, _ string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.cancelled = code
+	return nil
+}
+
+// fakeHandler is a handler for testBotUser that only talks to fakes and a
+// test store.
+type fakeHandler struct {
+	*Handler
+	sender   *fakeSender
+	images   *fakeImages
+	chat     *fakeChat
+	verifier *fakeVerifier
+}
+
+// newFakeHandler returns a handler with an SQLite store, in testRoom with
+// testAlice and testBob.
+func newFakeHandler(t *testing.T) *fakeHandler {
+	config := &Configuration{Username: testBotUser.String()}
+	config.SetDefaults()
+	getConfig := func() *Configuration { return config }
+	s := storetest.SQLite(t)
+
+	f := &fakeHandler{
+		sender:   &fakeSender{events: make(map[mid.EventID]*mevent.Event), media: make(map[mid.ContentURIString][]byte)},
+		images:   &fakeImages{image: testPNG(t, 64, 32), caption: "1girl, solo, long_hair"},
+		chat:     &fakeChat{reply: "Hello there!"},
+		verifier: &fakeVerifier{},
+	}
+	f.Handler = &Handler{
+		userID:  testBotUser,
+		sender:  f.sender,
+		images:  f.images,
+		chat:    f.chat,
+		store:   s,
+		limiter: NewLimiter(s, getConfig),
+		txt2txt: &Txt2txt{
+			historyFile: filepath.Join(t.TempDir(), "history.json"),
+			Histories:   make(map[string][]Message),
+		},
+		config: getConfig,
+	}
+	f.join(t, testRoom, testAlice, testBob)
+	return f
+}
+
+func (f *fakeHandler) join(t *testing.T, roomID mid.RoomID, members ...mid.UserID) {
+	for _, member := range append(members, testBotUser) {
+		if err := f.store.SetMembership(context.Background(), roomID, member, mevent.MembershipJoin); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// reply handles a message that replies to replyTo.
+func (f *fakeHandler) reply(roomID mid.RoomID, sender mid.UserID, replyTo mid.EventID, body string) {
+	content := &mevent.MessageEventContent{MsgType: mevent.MsgText, Body: body}
+	if replyTo != "" {
+		content.RelatesTo = (&mevent.RelatesTo{}).SetReplyTo(replyTo)
+	}
+	f.HandleMessage(context.Background(), &mevent.Event{
+		ID:      "$message",
+		RoomID:  roomID,
+		Sender:  sender,
+		Type:    mevent.EventMessage,
+		Content: mevent.Content{Parsed: content},
+	})
+}
+
+func (f *fakeHandler) usage(t *testing.T) []store.UsageEntry {
+	usage, err := f.store.ListUsage(context.Background(), time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return usage
+}
+
+// handlerTest is a message in testRoom to a fresh handler, from testAlice
+// unless sender is set. setup prepares the handler, for instance with images
+// to reply to, and check looks at what the handler did.
+type handlerTest struct {
+	name    string
+	setup   func(t *testing.T, f *fakeHandler)
+	sender  mid.UserID
+	replyTo mid.EventID
+	body    string
+	check   func(t *testing.T, f *fakeHandler)
+}
+
+func runHandlerTests(t *testing.T, tests []handlerTest) {
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newFakeHandler(t)
+			if test.setup != nil {
+				test.setup(t, f)
+			}
+			sender := test.sender
+			if sender == "" {
+				sender = testAlice
+			}
+			f.reply(testRoom, sender, test.replyTo, test.body)
+			test.check(t, f)
+		})
+	}
+}
+
+// postImages returns a setup that posts images by event ID, each replying
+// to the one before.
+func postImages(images ...[]byte) func(t *testing.T, f *fakeHandler) {
+	return func(t *testing.T, f *fakeHandler) {
+		var replyTo mid.EventID
+		for i, data := range images {
+			eventID := mid.EventID(fmt.Sprintf("$image%d", i))
+			f.sender.postImage(eventID, replyTo, data)
+			replyTo = eventID
+		}
+	}
+}
+
+func expectReply(substring string) func(t *testing.T, f *fakeHandler) {
+	return func(t *testing.T, f *fakeHandler) {
+		if len(f.sender.messages) != 1 || !strings.Contains(f.sender.messages[0].Body, substring) {
+			t.Errorf("expected a reply with %q, got %+v", substring, f.sender.messages)
+		}
+		if len(f.images.requests)+len(f.images.edits)+len(f.images.upscales) != 0 {
+			t.Error("expected no image job")
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	runHandlerTests(t, []handlerTest{{
+		name: "gen",
+		body: "!gen a lighthouse w:640 h:384",
+		check: func(t *testing.T, f *fakeHandler) {
+			if len(f.images.requests) != 1 || f.images.requests[0].Prompt != "a lighthouse" || f.images.requests[0].Width != 640 {
+				t.Fatalf("unexpected requests %+v", f.images.requests)
+			}
+			if got := strings.Join(f.sender.reactions, " "); got != "👌 ✔️" {
+				t.Errorf("expected the 👌 and ✔️ reactions, got %s", got)
+			}
+			if len(f.sender.messages) != 1 || f.sender.messages[0].URL != "mxc://example.com/1" || f.sender.messages[0].Info.Width != 64 {
+				t.Errorf("expected the uploaded image, got %+v", f.sender.messages)
+			}
+			if usage := f.usage(t); len(usage) != 1 || !usage[0].Success || usage[0].Images != 1 || usage[0].Model != "fake" {
+				t.Errorf("expected a successful job in the ledger, got %+v", usage)
+			}
+		},
+	}, {
+		name:  "chat failure",
+		setup: func(t *testing.T, f *fakeHandler) { f.chat.err = errors.New("out of memory") },
+		body:  "bot: how are you?",
+		check: func(t *testing.T, f *fakeHandler) {
+			if got := strings.Join(f.sender.reactions, " "); got != "❌" {
+				t.Errorf("expected the ❌ reaction, got %s", got)
+			}
+			if len(f.sender.messages) != 0 {
+				t.Errorf("expected no reply, got %+v", f.sender.messages)
+			}
+			if usage := f.usage(t); len(usage) != 1 || usage[0].Success || usage[0].Error != "out of memory" {
+				t.Errorf("expected a failed job in the ledger, got %+v", usage)
+			}
+		},
+	}, {
+		name: "forget",
+		setup: func(t *testing.T, f *fakeHandler) {
+			f.txt2txt.Histories[testRoom.String()] = []Message{{Role: "user", Content: "remember this"}}
+		},
+		body: "!forget",
+		check: func(t *testing.T, f *fakeHandler) {
+			if got := strings.Join(f.sender.reactions, " "); got != "🤯" {
+				t.Errorf("expected the 🤯 reaction, got %s", got)
+			}
+			if len(f.txt2txt.Histories[testRoom.String()]) != 0 {
+				t.Error("expected the history to be forgotten")
+			}
+		},
+	}, {
+		name:  "account without images",
+		setup: pirateAccount,
+		body:  "!gen a lighthouse",
+		check: func(t *testing.T, f *fakeHandler) {
+			if len(f.images.requests) != 0 {
+				t.Errorf("expected an account without images not to generate any, got %+v", f.images.requests)
+			}
+		},
+	}, {
+		name:   "message from another account",
+		setup:  pirateAccount,
+		sender: "@imagebot:example.com",
+		body:   "ping",
+		check: func(t *testing.T, f *fakeHandler) {
+			if len(f.sender.messages) != 0 {
+				t.Errorf("expected the other account to be ignored, got %+v", f.sender.messages)
+			}
+		},
+	}, {
+		name:  "account persona",
+		setup: pirateAccount,
+		body:  "pirate: ahoy",
+		check: func(t *testing.T, f *fakeHandler) {
+			if len(f.chat.requests) != 1 {
+				t.Fatalf("expected 1 chat request, got %d", len(f.chat.requests))
+			}
+			if first := f.chat.requests[0].Messages[0]; first.Role != "system" || first.Content != "Talk like a pirate." {
+				t.Errorf("expected the persona to come first, got %+v", first)
+			}
+			history := f.txt2txt.Histories[testRoom.String()]
+			if len(history) != 2 || history[0].Role != "user" {
+				t.Errorf("expected the history without the persona, got %+v", history)
+			}
+		},
+	}, {
+		name:  "admin command without admins",
+		setup: debugRoom,
+		body:  "!rooms",
+		check: expectReply("only admins"),
+	}, {
+		name: "admin command",
+		setup: func(t *testing.T, f *fakeHandler) {
+			debugRoom(t, f)
+			f.config().Admins = []string{testAlice.String()}
+		},
+		body:  "!rooms",
+		check: expectReply("joined 0 rooms"),
+	}, {
+		name: "verify",
+		setup: func(t *testing.T, f *fakeHandler) {
+			debugRoom(t, f)
+			f.config().Admins = []string{testAlice.String()}
+			pendingSAS.park("$verify", f.verifier, time.Hour)
+		},
+		body: "!verify $verify",
+		check: func(t *testing.T, f *fakeHandler) {
+			if !f.verifier.confirmed || f.verifier.cancelled != "" {
+				t.Errorf("expected the SAS to be confirmed, got %+v", f.verifier)
+			}
+		},
+	}, {
+		name: "reject verification",
+		setup: func(t *testing.T, f *fakeHandler) {
+			debugRoom(t, f)
+			f.config().Admins = []string{testAlice.String()}
+			pendingSAS.park("$reject", f.verifier, time.Hour)
+		},
+		body: "!reject $reject",
+		check: func(t *testing.T, f *fakeHandler) {
+			if f.verifier.confirmed || f.verifier.cancelled != mevent.VerificationCancelCodeSASMismatch {
+				t.Errorf("expected the verification to be cancelled, got %+v", f.verifier)
+			}
+		},
+	}, {
+		name: "verify without admins",
+		setup: func(t *testing.T, f *fakeHandler) {
+			debugRoom(t, f)
+			pendingSAS.park("$unverified", f.verifier, time.Hour)
+			t.Cleanup(func() { pendingSAS.take("$unverified") })
+		},
+		body: "!verify $unverified",
+		check: func(t *testing.T, f *fakeHandler) {
+			if f.verifier.confirmed {
+				t.Error("expected the SAS not to be confirmed")
+			}
+		},
+	}, {
+		name:  "inpaint without a reply",
+		body:  "!inpaint a cat",
+		check: expectReply("box:"),
+	}, {
+		name:    "inpaint a box",
+		setup:   postImages(testPNG(t, 200, 100)),
+		replyTo: "$image0",
+		body:    "!inpaint a cat box:50%,0,50%,100% blur:8 fill:noise",
+		check: func(t *testing.T, f *fakeHandler) {
+			if len(f.images.edits) != 1 {
+				t.Fatalf("expected 1 img2img request, got %d", len(f.images.edits))
+			}
+			edit := f.images.edits[0]
+			if edit.Prompt != "a cat" || edit.MaskBlur != 8 || edit.InpaintingFill != 2 || edit.Width != 200 || edit.Height != 96 {
+				t.Errorf("unexpected request %+v", edit.txt2img_request)
+			}
+			maskData, _ := base64.StdEncoding.DecodeString(edit.Mask)
+			mask, err := png.Decode(bytes.NewReader(maskData))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if left, right := color.GrayModel.Convert(mask.At(10, 50)), color.GrayModel.Convert(mask.At(150, 50)); left != (color.Gray{0}) || right != (color.Gray{255}) {
+				t.Errorf("expected the right half of the mask to be white, got %v and %v", left, right)
+			}
+			if usage := f.usage(t); len(usage) != 1 || usage[0].Kind != jobKindImg2Img {
+				t.Errorf("expected an img2img job in the ledger, got %+v", usage)
+			}
+		},
+	}, {
+		name:    "inpaint with a mask",
+		setup:   postImages(testPNG(t, 200, 100), testPNG(t, 200, 100)),
+		replyTo: "$image1",
+		body:    "!inpaint a dog",
+		check: func(t *testing.T, f *fakeHandler) {
+			if len(f.images.edits) != 1 {
+				t.Fatalf("expected 1 img2img request, got %d", len(f.images.edits))
+			}
+			if edit := f.images.edits[0]; edit.Mask != base64.StdEncoding.EncodeToString(testPNG(t, 200, 100)) {
+				t.Error("expected the mask image to be used")
+			}
+		},
+	}, {
+		name:    "inpaint with a mask of another size",
+		setup:   postImages(testPNG(t, 200, 100), testPNG(t, 100, 50)),
+		replyTo: "$image1",
+		body:    "!inpaint a dog",
+		check:   expectReply("The mask is 100x50 but the image is 200x100"),
+	}, {
+		name:    "extend",
+		setup:   postImages(testPNG(t, 128, 64)),
+		replyTo: "$image0",
+		body:    "!extend left:64 bottom:30 a beach",
+		check: func(t *testing.T, f *fakeHandler) {
+			if len(f.images.edits) != 1 {
+				t.Fatalf("expected 1 img2img request, got %d", len(f.images.edits))
+			}
+			edit := f.images.edits[0]
+			if edit.Prompt != "a beach" || edit.Width != 192 || edit.Height != 96 || edit.InpaintingMaskInvert != 1 {
+				t.Errorf("unexpected request %+v", edit.txt2img_request)
+			}
+			initData, _ := base64.StdEncoding.DecodeString(edit.InitImages[0])
+			padded, err := png.Decode(bytes.NewReader(initData))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if size := padded.Bounds().Size(); size != (image.Point{192, 96}) {
+				t.Errorf("expected a 192x96 canvas, got %v", size)
+			}
+			// The white pixel in the corner of the image is stretched to the left
+			if r, _, _, _ := padded.At(10, 0).RGBA(); r != 0xffff {
+				t.Error("expected the padding to continue the edge of the image")
+			}
+			if len(f.sender.messages) != 1 || f.sender.messages[0].Body != "seed: 1234" || f.sender.messages[0].FileName != "image.png" {
+				t.Errorf("expected the image with its seed, got %+v", f.sender.messages)
+			}
+		},
+	}, {
+		name:    "extend a large image",
+		setup:   postImages(testPNG(t, extendMaxSize+8, 8)),
+		replyTo: "$image0",
+		body:    "!extend left:64 a beach",
+		check:   expectReply("too large"),
+	}, {
+		name:    "upscale",
+		setup:   postImages(testPNG(t, 64, 32)),
+		replyTo: "$image0",
+		body:    "!upscale x3 upscaler:esrgan fr:1",
+		check: func(t *testing.T, f *fakeHandler) {
+			if len(f.images.upscales) != 1 {
+				t.Fatalf("expected 1 upscale request, got %d", len(f.images.upscales))
+			}
+			if upscale := f.images.upscales[0]; upscale.UpscalingResize != 3 || upscale.Upscaler1 != "ESRGAN_4x" || upscale.GFPGANVisibility != 1 {
+				t.Errorf("unexpected request %+v", upscale)
+			}
+			if len(f.sender.messages) != 1 || f.sender.messages[0].MsgType != mevent.MsgImage {
+				t.Errorf("expected an image, got %+v", f.sender.messages)
+			}
+		},
+	}, {
+		name: "upscale over the upload limit",
+		setup: func(t *testing.T, f *fakeHandler) {
+			postImages(testPNG(t, 64, 32))(t, f)
+			f.images.image = testNoise(t)
+			f.sender.maxUpload = int64(len(f.images.image) - 1)
+		},
+		replyTo: "$image0",
+		body:    "!upscale",
+		check: func(t *testing.T, f *fakeHandler) {
+			if len(f.sender.messages) != 1 || f.sender.messages[0].MsgType != mevent.MsgFile || f.sender.messages[0].Info.MimeType != "image/jpeg" {
+				t.Errorf("expected a JPEG file, got %+v", f.sender.messages)
+			}
+		},
+	}, {
+		name: "upscale far over the upload limit",
+		setup: func(t *testing.T, f *fakeHandler) {
+			postImages(testPNG(t, 64, 32))(t, f)
+			f.images.image = testNoise(t)
+			f.sender.maxUpload = 1000
+		},
+		replyTo: "$image0",
+		body:    "!upscale",
+		check: func(t *testing.T, f *fakeHandler) {
+			if len(f.sender.messages) != 1 || !strings.Contains(f.sender.messages[0].Body, "too large") {
+				t.Errorf("expected the image to be too large, got %+v", f.sender.messages)
+			}
+		},
+	}, {
+		name:    "upscale a large image",
+		setup:   postImages(testPNG(t, 1100, 1100)),
+		replyTo: "$image0",
+		body:    "!upscale x4",
+		check:   expectReply("too large to upscale x4"),
+	}, {
+		name:    "describe",
+		setup:   postImages(testPNG(t, 64, 32)),
+		replyTo: "$image0",
+		body:    "!describe model:deepdanbooru",
+		check: func(t *testing.T, f *fakeHandler) {
+			if len(f.images.captions) != 1 || f.images.captions[0].Model != "deepdanbooru" {
+				t.Fatalf("unexpected interrogate requests %+v", f.images.captions)
+			}
+			if len(f.sender.messages) != 1 || f.sender.messages[0].Body != "1girl, solo, long_hair" {
+				t.Errorf("expected the tags, got %+v", f.sender.messages)
+			}
+			if usage := f.usage(t); len(usage) != 1 || usage[0].Kind != jobKindInterrogate {
+				t.Errorf("expected an interrogate job in the ledger, got %+v", usage)
+			}
+		},
+	}, {
+		name:    "remix",
+		setup:   postImages(testPNG(t, 64, 32)),
+		replyTo: "$image0",
+		body:    "!remix at the beach count:2 ### blurry",
+		check: func(t *testing.T, f *fakeHandler) {
+			if len(f.images.captions) != 1 || f.images.captions[0].Model != "clip" {
+				t.Fatalf("unexpected interrogate requests %+v", f.images.captions)
+			}
+			if len(f.images.requests) != 1 {
+				t.Fatalf("expected 1 txt2img request, got %d", len(f.images.requests))
+			}
+			request := f.images.requests[0]
+			if request.Prompt != "1girl, solo, long_hair, at the beach" || request.NegativePrompt != "blurry" || request.NIter != 2 {
+				t.Errorf("unexpected request %+v", request)
+			}
+			if usage := f.usage(t); len(usage) != 1 || usage[0].Kind != jobKindTxt2Img || usage[0].Images != 2 {
+				t.Errorf("expected a txt2img job in the ledger, got %+v", usage)
+			}
+		},
+	}, {
+		name: "remix a caption with settings",
+		setup: func(t *testing.T, f *fakeHandler) {
+			postImages(testPNG(t, 64, 32))(t, f)
+			f.images.caption = "1girl, count:4 w:768"
+		},
+		replyTo: "$image0",
+		body:    "!remix at the beach",
+		check: func(t *testing.T, f *fakeHandler) {
+			if len(f.images.requests) != 1 {
+				t.Fatalf("expected 1 txt2img request, got %d", len(f.images.requests))
+			}
+			if request := f.images.requests[0]; request.Prompt != "1girl, at the beach" || request.NIter != 0 || request.Width != 512 {
+				t.Errorf("expected the settings in the caption to be dropped, got %+v", request)
+			}
+			if usage := f.usage(t); len(usage) != 1 || usage[0].Images != 1 {
+				t.Errorf("expected 1 image in the ledger, got %+v", usage)
+			}
+		},
+	}})
+}
+
+// debugRoom makes testRoom the debug room, where the handler answers admin
+// commands.
+func debugRoom(t *testing.T, f *fakeHandler) {
+	f.admin = true
+	f.config().DebugRoom = testRoom.String()
+}
+
+// pirateAccount configures the handler's account to chat as a pirate without
+// images, next to another account.
+func pirateAccount(t *testing.T, f *fakeHandler) {
+	config := &Configuration{Accounts: []AccountConfig{
+		{Username: testBotUser.String(), DisplayName: "pirate", Features: []string{featureChat}, Persona: "Talk like a pirate."},
+		{Username: "@imagebot:example.com"},
+	}}
+	config.SetDefaults()
+	f.config = func() *Configuration { return config }
+}
+
+// testNoise returns a PNG of noise, which compresses much better as a JPEG.
+func testNoise(t *testing.T) []byte {
+	noise := image.NewGray(image.Rect(0, 0, 256, 256))
+	random := rand.New(rand.NewSource(1))
+	for i := range noise.Pix {
+		noise.Pix[i] = uint8(i%256/2 + random.Intn(16))
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, noise); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// TestConcurrentChats chats in two rooms at once while the histories are
+// saved, for the race detector.
+func TestConcurrentChats(t *testing.T) {
+	f := newFakeHandler(t)
+	dm := mid.RoomID("!dm:example.com")
+	f.join(t, dm, testBob)
+
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		f.reply(testRoom, testAlice, "", "bot: hello")
+	}()
+	go func() {
+		defer wg.Done()
+		f.reply(dm, testBob, "", "hello")
+	}()
+	go func() {
+		defer wg.Done()
+		if err := f.txt2txt.SaveHistories(); err != nil {
+			t.Error(err)
+		}
+	}()
+	wg.Wait()
+
+	for _, roomID := range []mid.RoomID{testRoom, dm} {
+		if history := f.txt2txt.Histories[roomID.String()]; len(history) != 2 {
+			t.Errorf("expected the conversation in %s to be remembered, got %+v", roomID, history)
+		}
+	}
+}
+
+func TestSASTimeout(t *testing.T) {
+	verifier := &fakeVerifier{}
+	callbacks := &verificationCallbacks{helper: verifier, timeout: 10 * time.Millisecond}
+	callbacks.ShowSAS(context.Background(), "$timeout", []rune("🐶🐱"), []int{1, 2, 3})
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		verifier.lock.Lock()
+		confirmed, cancelled := verifier.confirmed, verifier.cancelled
+		verifier.lock.Unlock()
+		if confirmed {
+			t.Fatal("expected the SAS not to be confirmed without !verify")
+		}
+		if cancelled != "" {
+			if cancelled != mevent.VerificationCancelCodeTimeout {
+				t.Errorf("expected the verification to time out, got %s", cancelled)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the verification to be cancelled")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if err := pendingSAS.confirm(context.Background(), "$timeout"); err != errUnknownVerification {
+		t.Errorf("expected the verification to be gone after the timeout, got %v", err)
+	}
+}
@@ -0,0 +1,590 @@
+//
+// An in-process test harness: a fake Matrix homeserver and fake Automatic1111
+// and OpenAI-compatible backends, all served by httptest
+//
+
+package main
+
+import (
+	"bot/store"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mau.fi/util/dbutil"
+	"maunium.net/go/mautrix"
+	mcrypto "maunium.net/go/mautrix/crypto"
+	mevent "maunium.net/go/mautrix/event"
+	mid "maunium.net/go/mautrix/id"
+)
+
+const (
+	testBotUser     = mid.UserID("@bot:example.com")
+	testBotDevice   = mid.DeviceID("BOTDEVICE")
+	testAccessToken = "syt_test"
+	testServerName  = "example.com"
+)
+
+// fakeHomeserver implements just enough of the client-server API for the bot:
+// login, sync, sending events, typing, media, room state and the key
+// endpoints used for encryption.
+type fakeHomeserver struct {
+	*httptest.Server
+	t *testing.T
+
+	lock    sync.Mutex
+	wake    chan struct{}
+	batch   int
+	pending map[mid.RoomID]*mautrix.SyncJoinedRoom
+	state   map[mid.RoomID]map[string]*mevent.Event
+	sent    []*mevent.Event
+	media   map[string][]byte
+	typing  map[mid.RoomID]bool
+	nextID  int
+}
+
+func newFakeHomeserver(t *testing.T) *fakeHomeserver {
+	hs := &fakeHomeserver{
+		t:       t,
+		wake:    make(chan struct{}, 1),
+		pending: make(map[mid.RoomID]*mautrix.SyncJoinedRoom),
+		state:   make(map[mid.RoomID]map[string]*mevent.Event),
+		media:   make(map[string][]byte),
+		typing:  make(map[mid.RoomID]bool),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /_matrix/client/v3/login", hs.handleLogin)
+	mux.HandleFunc("GET /_matrix/client/v3/account/whoami", hs.authenticated(hs.handleWhoami))
+	mux.HandleFunc("POST /_matrix/client/v3/user/{userID}/filter", hs.authenticated(hs.handleFilter))
+	mux.HandleFunc("GET /_matrix/client/v3/sync", hs.authenticated(hs.handleSync))
+	mux.HandleFunc("PUT /_matrix/client/v3/rooms/{roomID}/send/{eventType}/{txnID}", hs.authenticated(hs.handleSend))
+	mux.HandleFunc("PUT /_matrix/client/v3/rooms/{roomID}/redact/{eventID}/{txnID}", hs.authenticated(hs.handleRedact))
+	mux.HandleFunc("PUT /_matrix/client/v3/rooms/{roomID}/typing/{userID}", hs.authenticated(hs.handleTyping))
+	mux.HandleFunc("GET /_matrix/client/v3/rooms/{roomID}/state/{eventType}/{stateKey...}", hs.authenticated(hs.handleState))
+	mux.HandleFunc("POST /_matrix/media/v3/upload", hs.authenticated(hs.handleUpload))
+	mux.HandleFunc("GET /_matrix/media/v3/download/{serverName}/{mediaID}", hs.handleDownload)
+	mux.HandleFunc("GET /_matrix/client/v1/media/download/{serverName}/{mediaID}", hs.authenticated(hs.handleDownload))
+	mux.HandleFunc("POST /_matrix/client/v3/keys/upload", hs.authenticated(hs.handleKeysUpload))
+	mux.HandleFunc("POST /_matrix/client/v3/keys/query", hs.authenticated(hs.handleKeysQuery))
+	mux.HandleFunc("POST /_matrix/client/v3/keys/claim", hs.authenticated(hs.handleEmpty))
+	mux.HandleFunc("PUT /_matrix/client/v3/sendToDevice/{eventType}/{txnID}", hs.authenticated(hs.handleEmpty))
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected request to the homeserver: %s %s", r.Method, r.URL.Path)
+		writeMatrixError(w, http.StatusNotFound, "M_UNRECOGNIZED", "Unrecognized request")
+	})
+
+	hs.Server = httptest.NewServer(mux)
+	t.Cleanup(hs.Close)
+	return hs
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeMatrixError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, map[string]string{"errcode": code, "error": message})
+}
+
+func (hs *fakeHomeserver) authenticated(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+testAccessToken {
+			writeMatrixError(w, http.StatusUnauthorized, "M_UNKNOWN_TOKEN", "Unknown access token")
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func (hs *fakeHomeserver) handleLogin(w http.ResponseWriter, r *http.Request) {
+	var req mautrix.ReqLogin
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeMatrixError(w, http.StatusBadRequest, "M_NOT_JSON", err.Error())
+		return
+	}
+	if req.Identifier.User != testBotUser.String() || req.Password != "passw0rd" {
+		writeMatrixError(w, http.StatusForbidden, "M_FORBIDDEN", "Invalid username or password")
+		return
+	}
+	writeJSON(w, http.StatusOK, mautrix.RespLogin{
+		AccessToken: testAccessToken,
+		DeviceID:    testBotDevice,
+		UserID:      testBotUser,
+	})
+}
+
+func (hs *fakeHomeserver) handleWhoami(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, mautrix.RespWhoami{UserID: testBotUser, DeviceID: testBotDevice})
+}
+
+func (hs *fakeHomeserver) handleFilter(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, mautrix.RespCreateFilter{FilterID: "1"})
+}
+
+// handleSync returns the events queued since the last sync, waiting up to the
+// requested timeout for some to arrive.
+func (hs *fakeHomeserver) handleSync(w http.ResponseWriter, r *http.Request) {
+	timeout, _ := strconv.Atoi(r.URL.Query().Get("timeout"))
+	hs.lock.Lock()
+	empty := len(hs.pending) == 0
+	hs.lock.Unlock()
+	if empty {
+		select {
+		case <-hs.wake:
+		case <-time.After(time.Duration(timeout) * time.Millisecond):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	hs.batch++
+	resp := mautrix.RespSync{NextBatch: strconv.Itoa(hs.batch)}
+	resp.Rooms.Join = make(map[mid.RoomID]*mautrix.SyncJoinedRoom)
+	for roomID, room := range hs.pending {
+		resp.Rooms.Join[roomID] = room
+	}
+	hs.pending = make(map[mid.RoomID]*mautrix.SyncJoinedRoom)
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (hs *fakeHomeserver) handleSend(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	event := &mevent.Event{
+		Sender: testBotUser,
+		Type:   mevent.Type{Type: r.PathValue("eventType"), Class: mevent.MessageEventType},
+		RoomID: mid.RoomID(r.PathValue("roomID")),
+	}
+	if err := json.Unmarshal(body, &event.Content); err != nil {
+		writeMatrixError(w, http.StatusBadRequest, "M_NOT_JSON", err.Error())
+		return
+	}
+	if err := event.Content.ParseRaw(event.Type); err != nil {
+		hs.t.Errorf("bot sent invalid %s content: %s", event.Type.Type, err)
+	}
+
+	hs.lock.Lock()
+	event.ID = hs.newEventID()
+	hs.sent = append(hs.sent, event)
+	hs.lock.Unlock()
+	writeJSON(w, http.StatusOK, mautrix.RespSendEvent{EventID: event.ID})
+}
+
+func (hs *fakeHomeserver) handleRedact(w http.ResponseWriter, r *http.Request) {
+	hs.lock.Lock()
+	event := &mevent.Event{
+		ID:      hs.newEventID(),
+		Sender:  testBotUser,
+		Type:    mevent.EventRedaction,
+		RoomID:  mid.RoomID(r.PathValue("roomID")),
+		Redacts: mid.EventID(r.PathValue("eventID")),
+	}
+	hs.sent = append(hs.sent, event)
+	hs.lock.Unlock()
+	writeJSON(w, http.StatusOK, mautrix.RespSendEvent{EventID: event.ID})
+}
+
+func (hs *fakeHomeserver) handleTyping(w http.ResponseWriter, r *http.Request) {
+	var req mautrix.ReqTyping
+	json.NewDecoder(r.Body).Decode(&req)
+	hs.lock.Lock()
+	hs.typing[mid.RoomID(r.PathValue("roomID"))] = req.Typing
+	hs.lock.Unlock()
+	writeJSON(w, http.StatusOK, struct{}{})
+}
+
+func (hs *fakeHomeserver) handleState(w http.ResponseWriter, r *http.Request) {
+	hs.lock.Lock()
+	event := hs.state[mid.RoomID(r.PathValue("roomID"))][r.PathValue("eventType")+"|"+r.PathValue("stateKey")]
+	hs.lock.Unlock()
+	if event == nil {
+		writeMatrixError(w, http.StatusNotFound, "M_NOT_FOUND", "Event not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, event.Content.Raw)
+}
+
+func (hs *fakeHomeserver) handleUpload(w http.ResponseWriter, r *http.Request) {
+	data, _ := io.ReadAll(r.Body)
+	hs.lock.Lock()
+	mediaID := fmt.Sprintf("media%d", len(hs.media)+1)
+	hs.media[mediaID] = data
+	hs.lock.Unlock()
+	writeJSON(w, http.StatusOK, mautrix.RespMediaUpload{
+		ContentURI: mid.ContentURI{Homeserver: testServerName, FileID: mediaID},
+	})
+}
+
+func (hs *fakeHomeserver) handleDownload(w http.ResponseWriter, r *http.Request) {
+	hs.lock.Lock()
+	data, ok := hs.media[r.PathValue("mediaID")]
+	hs.lock.Unlock()
+	if !ok {
+		writeMatrixError(w, http.StatusNotFound, "M_NOT_FOUND", "Media not found")
+		return
+	}
+	w.Write(data)
+}
+
+func (hs *fakeHomeserver) handleKeysUpload(w http.ResponseWriter, r *http.Request) {
+	var req mautrix.ReqUploadKeys
+	json.NewDecoder(r.Body).Decode(&req)
+	writeJSON(w, http.StatusOK, mautrix.RespUploadKeys{
+		OneTimeKeyCounts: mautrix.OTKCount{SignedCurve25519: len(req.OneTimeKeys)},
+	})
+}
+
+// handleKeysQuery reports that nobody has any devices, so room keys are only
+// shared with the bot itself.
+func (hs *fakeHomeserver) handleKeysQuery(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, mautrix.RespQueryKeys{DeviceKeys: map[mid.UserID]map[mid.DeviceID]mautrix.DeviceKeys{}})
+}
+
+func (hs *fakeHomeserver) handleEmpty(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, struct{}{})
+}
+
+func (hs *fakeHomeserver) newEventID() mid.EventID {
+	hs.nextID++
+	return mid.EventID(fmt.Sprintf("$event%d:%s", hs.nextID, testServerName))
+}
+
+// newEvent builds an event as the homeserver would deliver it.
+func (hs *fakeHomeserver) newEvent(roomID mid.RoomID, sender mid.UserID, evtType mevent.Type, stateKey *string, content any) *mevent.Event {
+	raw, err := json.Marshal(content)
+	if err != nil {
+		hs.t.Fatal(err)
+	}
+	hs.lock.Lock()
+	id := hs.newEventID()
+	hs.lock.Unlock()
+
+	event := &mevent.Event{
+		ID:        id,
+		Sender:    sender,
+		Type:      evtType,
+		RoomID:    roomID,
+		StateKey:  stateKey,
+		Timestamp: time.Now().UnixMilli(),
+	}
+	if err := json.Unmarshal(raw, &event.Content); err != nil {
+		hs.t.Fatal(err)
+	}
+	if err := event.Content.ParseRaw(evtType); err != nil {
+		hs.t.Fatal(err)
+	}
+	return event
+}
+
+// queue adds an event to the next sync response.
+func (hs *fakeHomeserver) queue(event *mevent.Event) {
+	hs.lock.Lock()
+	room := hs.pending[event.RoomID]
+	if room == nil {
+		room = &mautrix.SyncJoinedRoom{}
+		hs.pending[event.RoomID] = room
+	}
+	if event.StateKey != nil {
+		room.State.Events = append(room.State.Events, event)
+	} else {
+		room.Timeline.Events = append(room.Timeline.Events, event)
+	}
+	hs.lock.Unlock()
+
+	select {
+	case hs.wake <- struct{}{}:
+	default:
+	}
+}
+
+// setState stores a state event, which the bot can fetch and which is
+// delivered in the next sync.
+func (hs *fakeHomeserver) setState(roomID mid.RoomID, sender mid.UserID, evtType mevent.Type, stateKey string, content any) *mevent.Event {
+	evtType.Class = mevent.StateEventType
+	event := hs.newEvent(roomID, sender, evtType, &stateKey, content)
+	hs.lock.Lock()
+	if hs.state[roomID] == nil {
+		hs.state[roomID] = make(map[string]*mevent.Event)
+	}
+	hs.state[roomID][evtType.Type+"|"+stateKey] = event
+	hs.lock.Unlock()
+	hs.queue(event)
+	return event
+}
+
+// createRoom makes a room with the bot and the given users as members.
+func (hs *fakeHomeserver) createRoom(roomID mid.RoomID, members ...mid.UserID) {
+	for _, userID := range append([]mid.UserID{testBotUser}, members...) {
+		hs.setState(roomID, userID, mevent.StateMember, userID.String(), &mevent.MemberEventContent{
+			Membership:  mevent.MembershipJoin,
+			Displayname: userID.Localpart(),
+		})
+	}
+}
+
+// textMessage builds a text message event from a user.
+func (hs *fakeHomeserver) textMessage(roomID mid.RoomID, sender mid.UserID, body string) *mevent.Event {
+	return hs.newEvent(roomID, sender, mevent.EventMessage, nil, &mevent.MessageEventContent{
+		MsgType: mevent.MsgText,
+		Body:    body,
+	})
+}
+
+// sentEvents returns the events the bot sent so far, and forgets them.
+func (hs *fakeHomeserver) sentEvents() []*mevent.Event {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	sent := hs.sent
+	hs.sent = nil
+	return sent
+}
+
+// waitForSent waits until the bot sent at least n events.
+func (hs *fakeHomeserver) waitForSent(n int) []*mevent.Event {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		hs.lock.Lock()
+		count := len(hs.sent)
+		hs.lock.Unlock()
+		if count >= n {
+			return hs.sentEvents()
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	sent := hs.sentEvents()
+	hs.t.Fatalf("expected the bot to send %d events, got %d", n, len(sent))
+	return nil
+}
+
+func (hs *fakeHomeserver) download(uri mid.ContentURIString) []byte {
+	parsed, err := uri.Parse()
+	if err != nil {
+		hs.t.Fatal(err)
+	}
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	data, ok := hs.media[parsed.FileID]
+	if !ok {
+		hs.t.Fatalf("%s was never uploaded", uri)
+	}
+	return data
+}
+
+// fakeImageBackend serves the Automatic1111 txt2img API. It returns a blank
+// PNG of the requested size.
+type fakeImageBackend struct {
+	*httptest.Server
+
+	lock     sync.Mutex
+	requests []txt2img_request
+	fail     bool
+}
+
+func newFakeImageBackend(t *testing.T) *fakeImageBackend {
+	backend := &fakeImageBackend{}
+	backend.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req txt2img_request
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("invalid txt2img request: %s", err)
+		}
+		backend.lock.Lock()
+		backend.requests = append(backend.requests, req)
+		fail := backend.fail
+		backend.lock.Unlock()
+		if fail {
+			http.Error(w, "out of memory", http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, map[string]any{
+			"images": []string{base64.StdEncoding.EncodeToString(testPNG(t, req.Width, req.Height))},
+			"info":   `{"seed": 1234, "sd_model_name": "fake-model"}`,
+		})
+	}))
+	t.Cleanup(backend.Close)
+	return backend
+}
+
+func testPNG(t *testing.T, width, height int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	img.Set(0, 0, color.White)
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// fakeChatBackend serves an OpenAI-compatible chat completions API that
+// streams a fixed reply as server-sent events.
+type fakeChatBackend struct {
+	*httptest.Server
+
+	lock     sync.Mutex
+	requests []RequestData
+	reply    string
+}
+
+func newFakeChatBackend(t *testing.T) *fakeChatBackend {
+	backend := &fakeChatBackend{reply: "Hello there!"}
+	backend.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req RequestData
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("invalid chat request: %s", err)
+		}
+		backend.lock.Lock()
+		backend.requests = append(backend.requests, req)
+		reply := backend.reply
+		backend.lock.Unlock()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		stop := "stop"
+		half := len(reply) / 2
+		chunks := []IncomingData{
+			{Choices: []Resp{{Delta: Message{Role: "assistant", Content: reply[:half]}}}},
+			{Choices: []Resp{{Delta: Message{Role: "assistant", Content: reply[half:]}, FinishReason: &stop}},
+				Usage: Usage{PromptTokens: 10, CompletionTokens: 5, TotalTokens: 15}},
+		}
+		for _, chunk := range chunks {
+			data, _ := json.Marshal(chunk)
+			fmt.Fprintf(w, "data: %s\n\n", data)
+			w.(http.Flusher).Flush()
+		}
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	t.Cleanup(backend.Close)
+	return backend
+}
+
+// testBot is a bot wired to the fake homeserver and backends.
+type testBot struct {
+	hs    *fakeHomeserver
+	image *fakeImageBackend
+	chat  *fakeChatBackend
+
+	account *Account
+}
+
+// newTestBot logs the bot into a fake homeserver, with a fresh database and
+// the configuration changed by configure. With encryption, the bot gets an
+// Olm machine and encrypts messages to encrypted rooms.
+func newTestBot(t *testing.T, encryption bool, configure func(*Configuration)) *testBot {
+	tb := &testBot{
+		hs:    newFakeHomeserver(t),
+		image: newFakeImageBackend(t),
+		chat:  newFakeChatBackend(t),
+	}
+
+	dir := t.TempDir()
+	config := &Configuration{
+		Username:           testBotUser.String(),
+		Password:           "passw0rd",
+		Homeserver:         tb.hs.URL,
+		Txt2ImgAPIURL:      tb.image.URL,
+		Txt2TxtAPIURL:      tb.chat.URL,
+		Txt2TxtHistoryFile: filepath.Join(dir, "history.json"),
+		PickleKey:          "test pickle key",
+	}
+	config.SetDefaults()
+	if configure != nil {
+		configure(config)
+	}
+	Bot.configuration.Store(config)
+
+	db, dialect, err := openDatabase(filepath.Join(dir, "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	Bot.stateStore = store.NewStateStore(db, dialect)
+	if err := Bot.stateStore.Upgrade(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	Bot.limiter = NewLimiter(Bot.stateStore, Bot.Config)
+
+	tb.account, err = newAccount(context.Background(), &config.AccountConfigs()[0], db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tb.account.handler.admin = true
+	Bot.accounts = []*Account{tb.account}
+
+	if encryption {
+		utilDB, err := dbutil.NewWithDB(db, dialect.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		cryptoStore := mcrypto.NewSQLCryptoStore(utilDB, nil, testBotUser.String(), testBotDevice, []byte(config.PickleKey))
+		if err := cryptoStore.DB.Upgrade(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		tb.account.olmMachine = mcrypto.NewOlmMachine(tb.account.client, &tb.account.client.Log, cryptoStore, Bot.stateStore)
+		if err := tb.account.olmMachine.Load(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		tb.account.client.Crypto = &cryptoHelper{mach: tb.account.olmMachine}
+	}
+
+	t.Cleanup(func() {
+		waitForHandlers(10 * time.Second)
+		Bot.accounts, Bot.stateStore, Bot.limiter = nil, nil, nil
+		Bot.configuration.Store(nil)
+		db.Close()
+	})
+	return tb
+}
+
+// createRoom makes a room in the fake homeserver and tells the bot's state
+// store about its members, as a sync would.
+func (tb *testBot) createRoom(roomID mid.RoomID, encrypted bool, members ...mid.UserID) {
+	tb.hs.createRoom(roomID, members...)
+	if encrypted {
+		tb.hs.setState(roomID, members[0], mevent.StateEncryption, "", &mevent.EncryptionEventContent{Algorithm: mid.AlgorithmMegolmV1})
+	}
+	for _, room := range tb.hs.pending {
+		for _, event := range room.State.Events {
+			Bot.stateStore.UpdateState(context.Background(), event)
+		}
+	}
+	tb.hs.lock.Lock()
+	tb.hs.pending = make(map[mid.RoomID]*mautrix.SyncJoinedRoom)
+	tb.hs.lock.Unlock()
+}
+
+// handle runs the message handler on a message and returns the events the bot
+// sent in reply.
+func (tb *testBot) handle(roomID mid.RoomID, sender mid.UserID, body string) []*mevent.Event {
+	tb.account.handler.HandleMessage(context.Background(), tb.hs.textMessage(roomID, sender, body))
+	return tb.hs.sentEvents()
+}
+
+// decrypt decrypts an event the bot sent to an encrypted room with the bot's
+// own copy of the Megolm session.
+func (tb *testBot) decrypt(t *testing.T, event *mevent.Event) *mevent.Event {
+	t.Helper()
+	if event.Type != mevent.EventEncrypted {
+		t.Fatalf("expected an encrypted event, got %s", event.Type.Type)
+	}
+	event.Sender = testBotUser
+	decrypted, err := tb.account.olmMachine.DecryptMegolmEvent(context.Background(), event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return decrypted
+}
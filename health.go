@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// When the bot started
+var startedAt = time.Now()
+
+type healthCheck struct {
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type healthReport struct {
+	OK     bool                   `json:"ok"`
+	Checks map[string]healthCheck `json:"checks"`
+}
+
+func (report *healthReport) add(name string, ok bool, detail string) {
+	report.Checks[name] = healthCheck{OK: ok, Detail: detail}
+	report.OK = report.OK && ok
+}
+
+// checkLiveness reports whether every account is logged in and still
+// syncing. A bot failing these checks is wedged and should be restarted.
+func checkLiveness(report *healthReport) {
+	if len(Bot.accounts) == 0 {
+		report.add("login", false, "not logged in yet")
+		return
+	}
+
+	maxAge := time.Duration(Bot.Config().HealthMaxSyncAge) * time.Second
+	for _, account := range Bot.accounts {
+		// With several accounts, the checks are named after them
+		loginCheck, syncCheck := "login", "sync"
+		if len(Bot.accounts) > 1 {
+			loginCheck += " " + account.client.UserID.String()
+			syncCheck += " " + account.client.UserID.String()
+		}
+
+		if account.loginLost.Load() {
+			report.add(loginCheck, false, "the access token was rejected")
+		} else {
+			report.add(loginCheck, true, fmt.Sprintf("%s/%s", account.client.UserID, account.client.DeviceID))
+		}
+
+		if last := account.lastSync.Load(); last == 0 {
+			// Give the first sync as long as any other
+			age := time.Since(startedAt)
+			report.add(syncCheck, age < maxAge, fmt.Sprintf("no successful sync since the start %s ago", age.Round(time.Second)))
+		} else {
+			age := time.Since(time.Unix(0, last))
+			report.add(syncCheck, age < maxAge, fmt.Sprintf("last successful sync %s ago", age.Round(time.Second)))
+		}
+	}
+}
+
+// checkReadiness adds the database and the AI backends to the liveness
+// checks. A bot failing these can't serve commands right now.
+func checkReadiness(ctx context.Context, report *healthReport) {
+	checkLiveness(report)
+
+	if err := Bot.stateStore.DB.PingContext(ctx); err != nil {
+		report.add("database", false, err.Error())
+	} else {
+		report.add("database", true, "")
+	}
+
+	config := Bot.Config()
+	backends := map[string]string{
+		jobKindTxt2Img: config.Txt2ImgAPIURL,
+		jobKindTxt2Txt: config.Txt2TxtAPIURL,
+	}
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for kind, apiURL := range backends {
+		if apiURL == "" {
+			continue
+		}
+		wg.Add(1)
+		go func(kind, apiURL string) {
+			defer wg.Done()
+			latency, err := probeBackend(apiURL)
+
+			lock.Lock()
+			defer lock.Unlock()
+			if err != nil {
+				report.add(kind, false, err.Error())
+			} else {
+				report.add(kind, true, fmt.Sprintf("reachable in %s", latency.Round(time.Millisecond)))
+			}
+		}(kind, apiURL)
+	}
+	wg.Wait()
+}
+
+// healthHandler serves a health report as JSON, with status 503 if any check
+// failed.
+func healthHandler(check func(context.Context, *healthReport)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report := &healthReport{OK: true, Checks: make(map[string]healthCheck)}
+		check(r.Context(), report)
+
+		w.Header().Set("Content-Type", "application/json")
+		if !report.OK {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(report)
+	}
+}
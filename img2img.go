@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"strconv"
+	"strings"
+)
+
+// img2img_request is a txt2img request that starts from an existing image, as
+// accepted by the img2img API. The mask, if any, is white where the image is
+// repainted.
+type img2img_request struct {
+	txt2img_request
+	InitImages           []string `json:"init_images"`
+	ResizeMode           int      `json:"resize_mode,omitempty"`
+	Mask                 string   `json:"mask,omitempty"`
+	MaskBlur             int      `json:"mask_blur"`
+	InpaintingFill       int      `json:"inpainting_fill"`
+	InpaintingMaskInvert int      `json:"inpainting_mask_invert,omitempty"`
+}
+
+// img2imgMaxSize is the largest width or height images are edited at.
+const img2imgMaxSize = 1024
+
+// ParsePromptForImg2Img parses a prompt with the txt2img settings, except
+// hires fix, and the inpainting settings. The width and height are left at 0
+// unless they are set, to keep the size of the source image.
+func ParsePromptForImg2Img(prompt string) (img2img_request, maskShape) {
+	var request img2img_request
+	var shape maskShape
+	forcedSettings := map[string]bool{}
+
+	request.SamplerName = "Restart"
+	request.Steps = 20
+	request.DenoisingStrength = 0.75
+	request.MaskBlur = 4
+	request.InpaintingFill = 1
+
+	prompt = parseSettings(prompt, func(setting, value string) bool {
+		return handleInpaintSetting(&request, &shape, setting, value) ||
+			handleSetting(&request.txt2img_request, &forcedSettings, setting, value)
+	})
+	request.EnableHR = false
+
+	request.Prompt, request.NegativePrompt = splitPrompt(prompt)
+
+	return request, shape
+}
+
+func handleInpaintSetting(request *img2img_request, shape *maskShape, setting, value string) bool {
+	supportedFills := map[string]int{
+		"fill":     0,
+		"original": 1,
+		"noise":    2,
+		"nothing":  3,
+	}
+
+	switch setting {
+	case "blur":
+		if v, err := strconv.ParseInt(value, 10, 32); err == nil {
+			request.MaskBlur = clamp(int(v), 0, 64)
+		}
+		return true
+	case "fill":
+		if fill, ok := supportedFills[value]; ok {
+			request.InpaintingFill = fill
+		}
+		return true
+	case "box":
+		var box []length
+		for _, field := range strings.Split(value, ",") {
+			if l, ok := parseLength(field); ok {
+				box = append(box, l)
+			}
+		}
+		if len(box) == 4 {
+			shape.box, shape.center = box, nil
+		}
+		return true
+	case "center":
+		if l, ok := parseLength(value); ok {
+			shape.box, shape.center = nil, &l
+		}
+		return true
+	}
+	return false
+}
+
+// length is a distance in pixels, or in percent of the image size.
+type length struct {
+	value   float64
+	percent bool
+}
+
+func parseLength(s string) (length, bool) {
+	l := length{percent: strings.HasSuffix(s, "%")}
+	v, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+	if err != nil || v < 0 {
+		return l, false
+	}
+	l.value = v
+	return l, true
+}
+
+func (l length) pixels(size int) int {
+	if l.percent {
+		return int(l.value * float64(size) / 100)
+	}
+	return int(l.value)
+}
+
+// maskShape is the area to inpaint when it's given as geometry instead of a
+// mask image: box:x,y,w,h or center:size.
+type maskShape struct {
+	box    []length
+	center *length
+}
+
+func (m maskShape) isSet() bool {
+	return m.box != nil || m.center != nil
+}
+
+// rect returns the area in an image of the given size.
+func (m maskShape) rect(width, height int) image.Rectangle {
+	if m.center != nil {
+		w, h := m.center.pixels(width), m.center.pixels(height)
+		return image.Rect((width-w)/2, (height-h)/2, (width+w)/2, (height+h)/2)
+	}
+	x, y := m.box[0].pixels(width), m.box[1].pixels(height)
+	return image.Rect(x, y, x+m.box[2].pixels(width), y+m.box[3].pixels(height))
+}
+
+// rectMask returns a PNG mask of the given size that is white in the area and
+// black elsewhere.
+func rectMask(width, height int, area image.Rectangle) ([]byte, error) {
+	mask := image.NewGray(image.Rect(0, 0, width, height))
+	draw.Draw(mask, area, image.White, image.Point{}, draw.Src)
+
+	var buf bytes.Buffer
+	err := png.Encode(&buf, mask)
+	return buf.Bytes(), err
+}
+
+// fitSize scales an image size down to fit in maxSize and rounds it to the
+// multiples of 8 that the models work with.
+func fitSize(width, height, maxSize int) (int, int) {
+	if scale := float64(maxSize) / float64(max(width, height)); scale < 1 {
+		width, height = int(float64(width)*scale), int(float64(height)*scale)
+	}
+	return max(width&^7, 64), max(height&^7, 64)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"image"
+
+	"github.com/rs/zerolog"
+	mevent "maunium.net/go/mautrix/event"
+)
+
+const inpaintUsage = "reply to an image with `!inpaint <prompt> box:x,y,w,h` or `center:50%`, " +
+	"or reply to a mask that replies to the image with `!inpaint <prompt>`"
+
+// handleInpaint repaints part of the image that the message replies to. The
+// part is given by geometry in the prompt, or by a mask image that replies to
+// the image.
+func (h *Handler) handleInpaint(ctx context.Context, event *mevent.Event, content *mevent.MessageEventContent, prompt string) {
+	logger := zerolog.Ctx(ctx)
+	request, shape := ParsePromptForImg2Img(prompt)
+
+	target, source, ok := h.repliedImage(ctx, event, content, inpaintUsage)
+	if !ok {
+		return
+	}
+
+	var err error
+	var mask []byte
+	if !shape.isSet() {
+		// The message replies to the mask, which replies to the image
+		imageID := target.Content.AsMessage().GetReplyTo()
+		if imageID == "" {
+			h.sendMarkdown(ctx, event, inpaintUsage)
+			return
+		}
+		mask = source
+		if _, source, err = h.fetchImage(ctx, event.RoomID, imageID); err != nil {
+			logger.Warn().Err(err).Msgf("Couldn't fetch the image of %s", imageID)
+			h.sendReply(ctx, event, "Couldn't get the image your mask replies to")
+			return
+		}
+	}
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(source))
+	if err != nil {
+		h.sendReply(ctx, event, "Couldn't read the image you replied to")
+		return
+	}
+	if !shape.isSet() {
+		maskCfg, _, err := image.DecodeConfig(bytes.NewReader(mask))
+		if err != nil {
+			h.sendReply(ctx, event, "Couldn't read the mask you replied to")
+			return
+		}
+		if maskCfg.Width != cfg.Width || maskCfg.Height != cfg.Height {
+			h.sendReply(ctx, event, fmt.Sprintf("The mask is %dx%d but the image is %dx%d, they need to be the same size",
+				maskCfg.Width, maskCfg.Height, cfg.Width, cfg.Height))
+			return
+		}
+	} else {
+		area := shape.rect(cfg.Width, cfg.Height)
+		if area.Intersect(image.Rect(0, 0, cfg.Width, cfg.Height)).Empty() {
+			h.sendReply(ctx, event, "The area to inpaint is outside of the image")
+			return
+		}
+		if mask, err = rectMask(cfg.Width, cfg.Height, area); err != nil {
+			logger.Error().Err(err).Msg("Failed to draw the mask")
+			return
+		}
+	}
+	width, height := fitSize(cfg.Width, cfg.Height, img2imgMaxSize)
+	if request.Width == 0 {
+		request.Width = width
+	}
+	if request.Height == 0 {
+		request.Height = height
+	}
+	request.InitImages = []string{base64.StdEncoding.EncodeToString(source)}
+	request.Mask = base64.StdEncoding.EncodeToString(mask)
+
+	h.generateImage(ctx, event, jobKindImg2Img, imageCount(request.txt2img_request), func(ctx context.Context) ([]byte, txt2img_info, error) {
+		return h.images.EditImage(ctx, request)
+	}, nil)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bot/store"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	mevent "maunium.net/go/mautrix/event"
+)
+
+const (
+	jobKindTxt2Img     = "txt2img"
+	jobKindTxt2Txt     = "txt2txt"
+	jobKindImg2Img     = "img2img"
+	jobKindUpscale     = "upscale"
+	jobKindInterrogate = "interrogate"
+)
+
+// errShuttingDown is the cause of jobs that were cancelled because the bot is
+// stopping.
+var errShuttingDown = errors.New("the bot is shutting down")
+
+// Job is a single request to one of the AI backends on behalf of a user.
+type Job struct {
+	ID      uint64
+	Kind    string
+	Backend string
+	Model   string
+	Event   *mevent.Event
+	Started time.Time
+
+	handler *Handler
+	ctx     context.Context
+	cancel  context.CancelCauseFunc
+}
+
+var activeJobs = struct {
+	sync.Mutex
+	jobs map[*Job]struct{}
+}{jobs: make(map[*Job]struct{})}
+
+// StartJob registers a job for the handler. Its context is derived from ctx, so the job's
+// log lines carry the event's and the job's IDs.
+func (h *Handler) StartJob(ctx context.Context, event *mevent.Event, kind, apiURL string) *Job {
+	job := &Job{
+		Kind:    kind,
+		Backend: backendName(apiURL),
+		Event:   event,
+		Started: time.Now(),
+		handler: h,
+	}
+	ctx, job.ID = jobContext(ctx)
+	job.ctx, job.cancel = context.WithCancelCause(ctx)
+	zerolog.Ctx(job.ctx).Info().Msgf("Starting %s job on %s", kind, job.Backend)
+
+	activeJobs.Lock()
+	activeJobs.jobs[job] = struct{}{}
+	activeJobs.Unlock()
+	return job
+}
+
+// ActiveJobs returns the jobs that are currently running, oldest first.
+func ActiveJobs() []*Job {
+	activeJobs.Lock()
+	defer activeJobs.Unlock()
+
+	jobs := make([]*Job, 0, len(activeJobs.jobs))
+	for job := range activeJobs.jobs {
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Started.Before(jobs[j].Started) })
+	return jobs
+}
+
+// Context is cancelled when the job has to be abandoned. Requests to the
+// backend should be made with it.
+func (job *Job) Context() context.Context {
+	return job.ctx
+}
+
+// Interrupted returns whether the job was cancelled because the bot is
+// shutting down.
+func (job *Job) Interrupted() bool {
+	return context.Cause(job.ctx) == errShuttingDown
+}
+
+// cancelActiveJobs cancels every running job because the bot is shutting
+// down.
+func cancelActiveJobs() {
+	for _, job := range ActiveJobs() {
+		job.cancel(errShuttingDown)
+	}
+}
+
+// Finish records the outcome of the job in the usage ledger and reports
+// failures to the debug room. The user is told about jobs that were cancelled
+// by a shutdown.
+func (job *Job) Finish(usage Usage, images int, err error) {
+	activeJobs.Lock()
+	delete(activeJobs.jobs, job)
+	activeJobs.Unlock()
+
+	interrupted := job.Interrupted()
+	job.cancel(nil)
+	if interrupted {
+		err = errShuttingDown
+	}
+
+	entry := store.UsageEntry{
+		CreatedAt:        job.Started,
+		UserID:           job.Event.Sender.String(),
+		RoomID:           job.Event.RoomID.String(),
+		Kind:             job.Kind,
+		Backend:          job.Backend,
+		Model:            job.Model,
+		PromptTokens:     usage.PromptTokens,
+		CompletionTokens: usage.CompletionTokens,
+		Images:           images,
+		Duration:         time.Since(job.Started).Milliseconds(),
+		Success:          err == nil,
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+
+	observeJob(job, usage, images, err)
+	ctx := context.WithoutCancel(job.ctx)
+	if err := job.handler.store.RecordUsage(ctx, entry); err != nil {
+		zerolog.Ctx(ctx).Error().Err(err).Msgf("Failed to record %s job in the usage ledger", job.Kind)
+	}
+
+	if interrupted {
+		job.handler.sendReply(ctx, job.Event, "Sorry, I had to stop working on this because I'm restarting. Please try again in a minute.")
+	} else if err != nil {
+		job.handler.notifyDebugRoom(fmt.Sprintf("%s job for %s in %s on %s failed after %s: %s",
+			job.Kind, job.Event.Sender, job.Event.RoomID, job.Backend,
+			time.Since(job.Started).Round(time.Millisecond), err))
+	}
+}
+
+// backendName identifies a backend by the host of its API URL.
+func backendName(apiURL string) string {
+	if u, err := url.Parse(apiURL); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return apiURL
+}
+
+// probeBackend checks that the host of a backend API URL answers HTTP
+// requests at all. Any response, even an error status, counts as reachable.
+func probeBackend(apiURL string) (time.Duration, error) {
+	u, err := url.Parse(apiURL)
+	if err != nil {
+		return 0, err
+	}
+	switch u.Scheme {
+	case "ws":
+		u.Scheme = "http"
+	case "wss":
+		u.Scheme = "https"
+	}
+	u.Path, u.RawQuery = "/", ""
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	started := time.Now()
+	resp, err := client.Get(u.String())
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return time.Since(started), nil
+}
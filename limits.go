@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bot/store"
+	"context"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	mevent "maunium.net/go/mautrix/event"
+)
+
+const (
+	limitScopeUser = "user"
+	limitScopeRoom = "room"
+)
+
+// Cost describes what a single command consumes from the daily quotas.
+type Cost struct {
+	Images int
+	Tokens int
+}
+
+// Limiter enforces the token bucket rate limits and daily quotas configured in
+// Configuration.Limits. Its state lives in the state store so that it survives
+// restarts.
+type Limiter struct {
+	store  *store.StateStore
+	config func() *Configuration
+	now    func() time.Time
+	lock   sync.Mutex
+}
+
+func NewLimiter(stateStore *store.StateStore, config func() *Configuration) *Limiter {
+	return &Limiter{
+		store:  stateStore,
+		config: config,
+		now:    time.Now,
+	}
+}
+
+// Reservation is the expected cost of a command that Allow reserved in the
+// daily quotas, until Record settles it.
+type Reservation struct {
+	Cost
+	day string
+}
+
+type limitSubject struct {
+	scope    string
+	subject  string
+	settings LimitSettings
+}
+
+func (l *Limiter) subjectsForEvent(event *mevent.Event) []limitSubject {
+	limits := l.config().Limits
+	return []limitSubject{
+		{limitScopeUser, event.Sender.String(), limits.User},
+		{limitScopeRoom, event.RoomID.String(), limits.Room},
+	}
+}
+
+func (l *Limiter) today() string {
+	return l.now().UTC().Format("2006-01-02")
+}
+
+// Allow checks the daily quotas of the sender and the room against the
+// expected cost and takes one token from both of their rate limit buckets. The
+// expected cost is reserved in the quotas until Record settles it, so that
+// concurrent commands can't overrun them. If the command must be refused, the
+// returned string explains why in a way that can be sent back to the user.
+func (l *Limiter) Allow(ctx context.Context, event *mevent.Event, cost Cost) (Reservation, string, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	subjects := l.subjectsForEvent(event)
+	day := l.today()
+
+	for _, s := range subjects {
+		images, tokens, err := l.store.GetDailyUsage(ctx, s.scope, s.subject, day)
+		if err != nil {
+			return Reservation{}, "", err
+		}
+		if s.settings.DailyImages > 0 && cost.Images > 0 && images+cost.Images > s.settings.DailyImages {
+			return Reservation{}, fmt.Sprintf("Sorry, %s daily quota of %d images is used up. It resets at midnight UTC.",
+				possessiveSubject(s.scope), s.settings.DailyImages), nil
+		}
+		if s.settings.DailyTokens > 0 && cost.Tokens > 0 && tokens+cost.Tokens > s.settings.DailyTokens {
+			return Reservation{}, fmt.Sprintf("Sorry, %s daily quota of %d tokens is used up. It resets at midnight UTC.",
+				possessiveSubject(s.scope), s.settings.DailyTokens), nil
+		}
+	}
+
+	now := l.now()
+	remaining := make([]float64, len(subjects))
+	for i, s := range subjects {
+		tokens, err := l.bucketTokens(ctx, s, now)
+		if err != nil {
+			return Reservation{}, "", err
+		}
+		if s.settings.Burst > 0 && tokens < 1 {
+			if s.settings.PerMinute <= 0 {
+				return Reservation{}, fmt.Sprintf("Slow down a little, %s rate limit was hit.", possessiveSubject(s.scope)), nil
+			}
+			wait := time.Duration((1 - tokens) / s.settings.PerMinute * float64(time.Minute))
+			return Reservation{}, fmt.Sprintf("Slow down a little, %s rate limit was hit. Please try again in %s.",
+				possessiveSubject(s.scope), wait.Round(time.Second)), nil
+		}
+		remaining[i] = tokens
+	}
+
+	for i, s := range subjects {
+		if s.settings.Burst == 0 {
+			continue
+		}
+		if err := l.store.SaveBucket(ctx, s.scope, s.subject, remaining[i]-1, now); err != nil {
+			return Reservation{}, "", err
+		}
+	}
+
+	if cost != (Cost{}) {
+		for _, s := range subjects {
+			if err := l.store.AddDailyUsage(ctx, s.scope, s.subject, day, cost.Images, cost.Tokens); err != nil {
+				return Reservation{}, "", err
+			}
+		}
+	}
+	return Reservation{cost, day}, "", nil
+}
+
+// Record settles a reservation with the actual cost of a finished command in
+// the daily quotas of the sender and the room, on the day the reservation was
+// made. A command that failed has an actual cost of nothing, which refunds the
+// reservation.
+func (l *Limiter) Record(ctx context.Context, event *mevent.Event, reservation Reservation, actual Cost) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	images, tokens := actual.Images-reservation.Images, actual.Tokens-reservation.Tokens
+	if images == 0 && tokens == 0 {
+		return nil
+	}
+	day := reservation.day
+	if day == "" {
+		day = l.today()
+	}
+	for _, s := range l.subjectsForEvent(event) {
+		if err := l.store.AddDailyUsage(ctx, s.scope, s.subject, day, images, tokens); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bucketTokens returns the number of tokens currently in the bucket, taking
+// the refill since the last update into account.
+func (l *Limiter) bucketTokens(ctx context.Context, s limitSubject, now time.Time) (float64, error) {
+	if s.settings.Burst == 0 {
+		return math.Inf(1), nil
+	}
+
+	tokens, updatedAt, found, err := l.store.LoadBucket(ctx, s.scope, s.subject)
+	if err != nil {
+		return 0, err
+	}
+	if !found {
+		return float64(s.settings.Burst), nil
+	}
+
+	elapsed := now.Sub(updatedAt).Minutes()
+	if elapsed > 0 {
+		tokens += elapsed * s.settings.PerMinute
+	}
+	return math.Min(tokens, float64(s.settings.Burst)), nil
+}
+
+// Quota renders the remaining allowance of the sender and the room as markdown.
+func (l *Limiter) Quota(ctx context.Context, event *mevent.Event) (string, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	var sb strings.Builder
+	sb.WriteString("| | requests | images today | tokens today |\n| --- | --- | --- | --- |\n")
+
+	now := l.now()
+	day := l.today()
+	for _, s := range l.subjectsForEvent(event) {
+		images, tokens, err := l.store.GetDailyUsage(ctx, s.scope, s.subject, day)
+		if err != nil {
+			return "", err
+		}
+		bucket, err := l.bucketTokens(ctx, s, now)
+		if err != nil {
+			return "", err
+		}
+
+		requests := "unlimited"
+		if s.settings.Burst > 0 {
+			requests = fmt.Sprintf("%d of %d", int(bucket), s.settings.Burst)
+		}
+		fmt.Fprintf(&sb, "| %s | %s | %s | %s |\n", describeSubject(s.scope), requests,
+			remainingQuota(images, s.settings.DailyImages), remainingQuota(tokens, s.settings.DailyTokens))
+	}
+	return sb.String(), nil
+}
+
+func remainingQuota(used, limit int) string {
+	if limit == 0 {
+		return fmt.Sprintf("%d used", used)
+	}
+	return fmt.Sprintf("%d of %d left", max(limit-used, 0), limit)
+}
+
+func describeSubject(scope string) string {
+	if scope == limitScopeRoom {
+		return "this room"
+	}
+	return "you"
+}
+
+func possessiveSubject(scope string) string {
+	if scope == limitScopeRoom {
+		return "this room's"
+	}
+	return "your"
+}
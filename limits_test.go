@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bot/store"
+	"bot/store/storetest"
+	"context"
+	"testing"
+	"time"
+
+	mevent "maunium.net/go/mautrix/event"
+	mid "maunium.net/go/mautrix/id"
+)
+
+func TestLimiter(t *testing.T) {
+	Bot.configuration.Store(&Configuration{
+		Limits: Limits{
+			User: LimitSettings{Burst: 2, PerMinute: 1, DailyImages: 3},
+		},
+	})
+	defer Bot.configuration.Store(nil)
+
+	storetest.ForEachStore(t, func(t *testing.T, stateStore *store.StateStore) {
+		testLimiter(t, NewLimiter(stateStore, Bot.Config))
+	})
+}
+
+func testLimiter(t *testing.T, limiter *Limiter) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	limiter.now = func() time.Time { return now }
+
+	event := &mevent.Event{Sender: mid.UserID("@alice:example.com"), RoomID: mid.RoomID("!room:example.com")}
+	var reservation Reservation
+	allow := func(cost Cost) string {
+		r, refusal, err := limiter.Allow(context.Background(), event, cost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reservation = r
+		return refusal
+	}
+
+	if refusal := allow(Cost{Images: 1}); refusal != "" {
+		t.Fatalf("first request refused: %s", refusal)
+	}
+	if refusal := allow(Cost{Images: 1}); refusal != "" {
+		t.Fatalf("second request refused: %s", refusal)
+	}
+	if refusal := allow(Cost{Images: 1}); refusal == "" {
+		t.Fatal("third request within a burst of 2 was allowed")
+	}
+
+	now = now.Add(time.Minute)
+	if refusal := allow(Cost{Images: 1}); refusal != "" {
+		t.Fatalf("request after refill refused: %s", refusal)
+	}
+
+	// The three allowed requests reserved the daily quota of 3 images
+	now = now.Add(time.Hour)
+	if refusal := allow(Cost{Images: 1}); refusal == "" {
+		t.Fatal("request over the daily image quota was allowed")
+	}
+
+	if err := limiter.Record(context.Background(), event, Reservation{Cost{Images: 1}, limiter.today()}, Cost{}); err != nil {
+		t.Fatal(err)
+	}
+	if refusal := allow(Cost{Images: 1}); refusal != "" {
+		t.Fatalf("request after a refund refused: %s", refusal)
+	}
+	if err := limiter.Record(context.Background(), event, reservation, Cost{Images: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if refusal := allow(Cost{Images: 1}); refusal == "" {
+		t.Fatal("request over the daily image quota was allowed")
+	}
+	now = now.Add(time.Minute)
+	if refusal := allow(Cost{Tokens: 1}); refusal != "" {
+		t.Fatalf("chat request without a token quota refused: %s", refusal)
+	}
+
+	now = now.Add(24 * time.Hour)
+	if refusal := allow(Cost{Images: 1}); refusal != "" {
+		t.Fatalf("request on the next day refused: %s", refusal)
+	}
+}
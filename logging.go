@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	mevent "maunium.net/go/mautrix/event"
+)
+
+const (
+	logFormatJSON    = "json"
+	logFormatConsole = "console"
+)
+
+// setupLogging replaces the global logger with one in the configured format
+// and returns it. Loggers in a context derive from it.
+func setupLogging(config *Configuration) *zerolog.Logger {
+	var writer io.Writer = os.Stderr
+	if config.LogFormat == logFormatConsole {
+		writer = zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: time.RFC3339}
+	}
+	log.Logger = zerolog.New(writer).With().Timestamp().Logger()
+	zerolog.DefaultContextLogger = &log.Logger
+	applyLogLevel(config)
+	return &log.Logger
+}
+
+// applyLogLevel sets the level of every logger. It can change on a reload.
+func applyLogLevel(config *Configuration) {
+	level, err := zerolog.ParseLevel(config.LogLevel)
+	if err != nil {
+		log.Warn().Err(err).Msg("Invalid log_level, logging at info")
+		level = zerolog.InfoLevel
+	}
+	zerolog.SetGlobalLevel(level)
+}
+
+// eventContext returns a context whose logger adds the room, event and sender
+// to every line, so that the lines of one message can be found together.
+func eventContext(ctx context.Context, event *mevent.Event) context.Context {
+	return zerolog.Ctx(ctx).With().
+		Stringer("room_id", event.RoomID).
+		Stringer("event_id", event.ID).
+		Stringer("sender", event.Sender).
+		Logger().WithContext(ctx)
+}
+
+var lastJobID atomic.Uint64
+
+// jobContext returns a context whose logger also adds a new job ID.
+func jobContext(ctx context.Context) (context.Context, uint64) {
+	id := lastJobID.Add(1)
+	return zerolog.Ctx(ctx).With().Uint64("job_id", id).Logger().WithContext(ctx), id
+}
+
+// redact keeps what users wrote out of the logs, unless log_message_content
+// is enabled. Logging is set up for the whole process, so this follows the
+// bot's configuration rather than an account's.
+func redact(text string) string {
+	if config := Bot.Config(); config != nil && config.LogMessageContent {
+		return text
+	}
+	return fmt.Sprintf("<%d bytes redacted>", len(text))
+}
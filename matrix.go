@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix"
+	mevent "maunium.net/go/mautrix/event"
+	mid "maunium.net/go/mautrix/id"
+)
+
+// matrixSender is the MatrixSender of a logged in client.
+type matrixSender struct {
+	client *mautrix.Client
+}
+
+func (s *matrixSender) SendMessage(ctx context.Context, roomID mid.RoomID, content *mevent.MessageEventContent) (mid.EventID, error) {
+	logger := zerolog.Ctx(ctx)
+	eventContent := &mevent.Content{Parsed: content}
+	r, err := DoRetry("send message", func() (interface{}, error) {
+		isEncrypted, err := s.client.StateStore.IsEncrypted(ctx, roomID)
+		if err != nil {
+			logger.Error().Err(err).Msg("Error checking if the state store is encrypted")
+			return nil, err
+		}
+		if isEncrypted {
+			if s.client.Crypto == nil {
+				return nil, errors.New("encryption isn't set up")
+			}
+			logger.Debug().Msgf("Sending encrypted event to %s", roomID)
+			encrypted, err := s.client.Crypto.Encrypt(ctx, roomID, mevent.EventMessage, eventContent)
+			if err != nil {
+				logger.Error().Err(err).Msgf("Failed to encrypt message to %s", roomID)
+				return nil, err
+			}
+
+			encrypted.RelatesTo = content.RelatesTo // The m.relates_to field should be unencrypted, so copy it.
+			return s.client.SendMessageEvent(ctx, roomID, mevent.EventEncrypted, encrypted)
+		} else {
+			logger.Debug().Msgf("Sending unencrypted event to %s", roomID)
+			return s.client.SendMessageEvent(ctx, roomID, mevent.EventMessage, eventContent)
+		}
+	})
+	if err != nil {
+		// give up
+		logger.Error().Err(err).Msgf("Failed to send message to %s", roomID)
+		return "", err
+	}
+	return r.(*mautrix.RespSendEvent).EventID, nil
+}
+
+func (s *matrixSender) SendReaction(ctx context.Context, roomID mid.RoomID, eventID mid.EventID, key string) error {
+	_, err := s.client.SendReaction(ctx, roomID, eventID, key)
+	return err
+}
+
+func (s *matrixSender) UploadMedia(ctx context.Context, data []byte, contentType string) (mid.ContentURIString, error) {
+	resp, err := s.client.UploadMedia(ctx, mautrix.ReqUploadMedia{
+		ContentBytes: data,
+		ContentType:  contentType,
+	})
+	if err != nil {
+		return "", err
+	}
+	return resp.ContentURI.CUString(), nil
+}
+
+func (s *matrixSender) UserTyping(ctx context.Context, roomID mid.RoomID, typing bool, timeout time.Duration) error {
+	_, err := s.client.UserTyping(ctx, roomID, typing, timeout)
+	return err
+}
+
+func (s *matrixSender) StateEvent(ctx context.Context, roomID mid.RoomID, evtType mevent.Type, stateKey string, content any) error {
+	return s.client.StateEvent(ctx, roomID, evtType, stateKey, content)
+}
+
+func (s *matrixSender) JoinedRooms(ctx context.Context) ([]mid.RoomID, error) {
+	resp, err := s.client.JoinedRooms(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return resp.JoinedRooms, nil
+}
+
+func (s *matrixSender) LeaveRoom(ctx context.Context, roomID mid.RoomID) error {
+	_, err := s.client.LeaveRoom(ctx, roomID)
+	return err
+}
+
+func (s *matrixSender) GetEvent(ctx context.Context, roomID mid.RoomID, eventID mid.EventID) (*mevent.Event, error) {
+	event, err := s.client.GetEvent(ctx, roomID, eventID)
+	if err != nil {
+		return nil, err
+	}
+	event.RoomID = roomID
+	if err := event.Content.ParseRaw(event.Type); err != nil {
+		return nil, err
+	}
+	if event.Type == mevent.EventEncrypted {
+		if s.client.Crypto == nil {
+			return nil, errors.New("encryption isn't set up")
+		}
+		return s.client.Crypto.Decrypt(ctx, event)
+	}
+	return event, nil
+}
+
+func (s *matrixSender) DownloadMedia(ctx context.Context, uri mid.ContentURIString) ([]byte, error) {
+	parsed, err := uri.Parse()
+	if err != nil {
+		return nil, err
+	}
+	return s.client.DownloadBytes(ctx, parsed)
+}
+
+func (s *matrixSender) MaxUploadSize(ctx context.Context) (int64, error) {
+	resp, err := s.client.GetMediaConfig(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return resp.UploadSize, nil
+}
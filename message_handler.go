@@ -3,93 +3,174 @@ package main
 import (
 	"bytes"
 	"context"
+	"errors"
 	"image"
 	"net/http"
 	"os"
 	"strings"
 	"time"
 
-	_ "github.com/mattn/go-sqlite3"
-	"github.com/rs/zerolog/log"
-	"maunium.net/go/mautrix"
+	"github.com/rs/zerolog"
 	"maunium.net/go/mautrix/crypto/attachment"
 	mevent "maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/format"
+	mid "maunium.net/go/mautrix/id"
 )
 
-func HandleMessage(ctx context.Context, event *mevent.Event) {
-	if event.Sender.String() == Bot.configuration.Username {
-		log.Info().Msgf("Event %s is from us, so not going to respond.", event.ID)
+// HandleMessage answers a message sent to a room the account is in.
+func (h *Handler) HandleMessage(ctx context.Context, event *mevent.Event) {
+	defer h.reportPanic(event)
+	ctx = eventContext(ctx, event)
+	logger := zerolog.Ctx(ctx)
+
+	if event.Sender == h.userID || h.config().IsAccount(event.Sender) {
+		logger.Info().Msg("Event is from us, so not going to respond.")
+		return
+	}
+
+	if blocked, err := h.store.IsBlocked(ctx, event.Sender); err != nil {
+		logger.Error().Err(err).Msg("Failed to check if the sender is blocked")
+	} else if blocked {
+		logger.Info().Msg("Event is from a blocked user, so not going to respond.")
 		return
 	}
 
-	log.Info().Msgf("Parsed content: %s", event.Content.Parsed)
+	account := h.account()
 	content := event.Content.AsMessage()
 	content.RemoveReplyFallback()
 	body := content.Body
+	logger.Info().Msgf("Received %s: %s", content.MsgType, redact(body))
 	switch content.MsgType {
 	case mevent.MsgText, mevent.MsgNotice:
+		if h.admin && h.isDebugRoom(event.RoomID) && h.handleAdminCommand(ctx, event, body) {
+			messagesHandled.WithLabelValues("admin").Inc()
+			return
+		}
+
 		if body == "ping" {
-			sendReply(event, "pong")
+			messagesHandled.WithLabelValues("ping").Inc()
+			h.sendReply(ctx, event, "pong")
 			return
 		}
 
 		if body == "yay" {
-			sendReaction(event, "🎉")
+			messagesHandled.WithLabelValues("yay").Inc()
+			h.sendReaction(ctx, event, "🎉")
 			return
 		}
 
-		if body == "!gen help" {
+		if body == "!gen help" && account.HasFeature(featureImages) {
+			messagesHandled.WithLabelValues("help").Inc()
 			if help, err := os.ReadFile("./help.md"); err == nil {
-				sendMarkdown(event, string(help))
+				h.sendMarkdown(ctx, event, string(help))
 			}
 			return
 		}
 
 		if body == "!forget" {
-			delete(Bot.txt2txt.Histories, string(event.RoomID))
-			err := Bot.txt2txt.SaveHistories()
+			messagesHandled.WithLabelValues("forget").Inc()
+			if err := h.txt2txt.Forget(event.RoomID); err != nil {
+				logger.Error().Err(err).Msg("Failed to save history")
+				h.sendReply(ctx, event, "Couldn't forget")
+				return
+			}
+			h.sendReaction(ctx, event, "🤯")
+			return
+		}
+
+		if body == "!quota" {
+			messagesHandled.WithLabelValues("quota").Inc()
+			quota, err := h.limiter.Quota(ctx, event)
 			if err != nil {
-				log.Error().Err(err).Msg("Failed to save history")
-				sendReply(event, "Couldn't forget")
+				logger.Error().Err(err).Msg("Failed to look up quota")
+				h.sendReply(ctx, event, "Couldn't look up your quota")
 				return
 			}
-			sendReaction(event, "🤯")
+			h.sendMarkdown(ctx, event, quota)
 			return
 		}
 
-		if strings.HasPrefix(body, "!gen ") {
+		if body == "!stats" || strings.HasPrefix(body, "!stats ") {
+			messagesHandled.WithLabelValues("stats").Inc()
+			h.handleStats(ctx, event, strings.TrimSpace(strings.TrimPrefix(body, "!stats")))
+			return
+		}
+
+		if strings.HasPrefix(body, "!gen ") && account.HasFeature(featureImages) {
 			prompt := strings.TrimPrefix(body, "!gen ")
 			if len(prompt) == 0 {
 				break
 			}
-			sendReaction(event, "👌")
-			if image, err := getImageForPrompt(event, prompt); err != nil {
-				sendReply(event, "i'm sorry dave, i'm afraid i can't do that")
-				sendReaction(event, "❌")
-			} else {
-				sendImage(event, "image.jpg", image)
-				sendReaction(event, "✔️")
-			}
+			messagesHandled.WithLabelValues("gen").Inc()
+			request := ParsePromptForTxt2Img(prompt)
+			h.generateImage(ctx, event, jobKindTxt2Img, imageCount(request), func(ctx context.Context) ([]byte, txt2img_info, error) {
+				return h.images.GenerateImage(ctx, request)
+			}, nil)
+			return
+		}
+
+		if (body == "!inpaint" || strings.HasPrefix(body, "!inpaint ")) && account.HasFeature(featureImages) {
+			messagesHandled.WithLabelValues("inpaint").Inc()
+			h.handleInpaint(ctx, event, content, strings.TrimSpace(strings.TrimPrefix(body, "!inpaint")))
+			return
+		}
+
+		if (body == "!extend" || strings.HasPrefix(body, "!extend ")) && account.HasFeature(featureImages) {
+			messagesHandled.WithLabelValues("extend").Inc()
+			h.handleExtend(ctx, event, content, strings.TrimSpace(strings.TrimPrefix(body, "!extend")))
 			return
 		}
 
-		if strings.HasPrefix(body, Bot.configuration.DisplayName+": ") || len(Bot.stateStore.GetRoomMembers(event.RoomID)) == 2 {
-			prompt := strings.TrimPrefix(body, Bot.configuration.DisplayName+": ")
+		if (body == "!upscale" || strings.HasPrefix(body, "!upscale ")) && account.HasFeature(featureImages) {
+			messagesHandled.WithLabelValues("upscale").Inc()
+			h.handleUpscale(ctx, event, content, strings.TrimSpace(strings.TrimPrefix(body, "!upscale")))
+			return
+		}
+
+		if (body == "!describe" || strings.HasPrefix(body, "!describe ")) && account.HasFeature(featureImages) {
+			messagesHandled.WithLabelValues("describe").Inc()
+			h.handleDescribe(ctx, event, content, strings.TrimSpace(strings.TrimPrefix(body, "!describe")))
+			return
+		}
+
+		if (body == "!remix" || strings.HasPrefix(body, "!remix ")) && account.HasFeature(featureImages) {
+			messagesHandled.WithLabelValues("remix").Inc()
+			h.handleRemix(ctx, event, content, strings.TrimSpace(strings.TrimPrefix(body, "!remix")))
+			return
+		}
+
+		mention := account.DisplayName + ": "
+		if account.HasFeature(featureChat) && (strings.HasPrefix(body, mention) || h.isDirectChat(ctx, event.RoomID)) {
+			prompt := strings.TrimPrefix(body, mention)
 			if len(prompt) == 0 {
 				break
 			}
 
-			Bot.client.UserTyping(ctx, event.RoomID, true, 10*time.Second)
+			messagesHandled.WithLabelValues("chat").Inc()
+			estimate := h.txt2txt.EstimateTokens(event.RoomID, account.Persona, prompt)
+			reservation, ok := h.allowedByLimiter(ctx, event, Cost{Tokens: estimate})
+			if !ok {
+				return
+			}
+
+			h.sender.UserTyping(ctx, event.RoomID, true, 10*time.Second)
 
-			reply, err := Bot.txt2txt.GetPredictionForPrompt(event, prompt)
-			if err != nil || len(reply) == 0 {
-				sendReaction(event, "❌")
+			job := h.StartJob(ctx, event, jobKindTxt2Txt, h.config().Txt2TxtAPIURL)
+			job.Model = txt2txtModel
+			reply, usage, err := h.txt2txt.GetPredictionForPrompt(job.Context(), h.chat, event.RoomID,
+				h.displayName(ctx, event.RoomID, event.Sender), account.Persona, prompt)
+			if err == nil && len(reply) == 0 {
+				err = errors.New("empty reply")
+			}
+			if err != nil {
+				h.sendReaction(ctx, event, "❌")
 			} else {
-				sendMarkdown(event, strings.TrimPrefix(reply, "### Assistant:"))
+				h.sendMarkdown(ctx, event, strings.TrimPrefix(reply, "### Assistant:"))
 			}
+			h.recordUsage(ctx, event, reservation, Cost{Tokens: usage.TotalTokens})
+			job.Finish(usage, 0, err)
 
-			Bot.client.UserTyping(ctx, event.RoomID, false, 0)
+			h.sender.UserTyping(ctx, event.RoomID, false, 0)
 
 			return
 		}
@@ -102,16 +183,75 @@ func HandleMessage(ctx context.Context, event *mevent.Event) {
 	}
 }
 
-func sendReaction(event *mevent.Event, reaction string) {
-	Bot.client.SendReaction(context.Background(), event.RoomID, event.ID, reaction)
+// generateImage runs an image job within the limits and replies with the
+// image, or apologizes when the backend fails. The image is sent with reply
+// if it's set.
+func (h *Handler) generateImage(ctx context.Context, event *mevent.Event, kind string, images int,
+	generate func(ctx context.Context) ([]byte, txt2img_info, error), reply func(image []byte, info txt2img_info)) {
+	cost := Cost{Images: images}
+	reservation, ok := h.allowedByLimiter(ctx, event, cost)
+	if !ok {
+		return
+	}
+	h.sendReaction(ctx, event, "👌")
+	job := h.StartJob(ctx, event, kind, h.config().Txt2ImgAPIURL)
+	image, info, err := generate(job.Context())
+	job.Model = info.SDModelName
+	if err != nil {
+		if !job.Interrupted() {
+			h.sendReply(ctx, event, "i'm sorry dave, i'm afraid i can't do that")
+		}
+		h.sendReaction(ctx, event, "❌")
+		h.recordUsage(ctx, event, reservation, Cost{})
+		job.Finish(Usage{}, 0, err)
+	} else {
+		if reply != nil {
+			reply(image, info)
+		} else {
+			h.sendImage(ctx, event, "image.jpg", image)
+		}
+		h.sendReaction(ctx, event, "✔️")
+		h.recordUsage(ctx, event, reservation, cost)
+		job.Finish(Usage{}, cost.Images, nil)
+	}
+}
+
+// allowedByLimiter checks the rate limits and quotas for a command and politely
+// tells the sender when they have been exceeded. The returned reservation must
+// be settled with recordUsage when the command is done.
+func (h *Handler) allowedByLimiter(ctx context.Context, event *mevent.Event, cost Cost) (Reservation, bool) {
+	reservation, refusal, err := h.limiter.Allow(ctx, event, cost)
+	if err != nil {
+		// Don't punish users for our own database problems
+		zerolog.Ctx(ctx).Error().Err(err).Msg("Failed to check rate limits")
+		return Reservation{}, true
+	}
+	if refusal != "" {
+		zerolog.Ctx(ctx).Info().Msgf("Refusing command: %s", refusal)
+		h.sendReply(ctx, event, refusal)
+		return Reservation{}, false
+	}
+	return reservation, true
+}
+
+func (h *Handler) recordUsage(ctx context.Context, event *mevent.Event, reservation Reservation, actual Cost) {
+	if err := h.limiter.Record(ctx, event, reservation, actual); err != nil {
+		zerolog.Ctx(ctx).Error().Err(err).Msg("Failed to record usage")
+	}
 }
 
-func sendMarkdown(event *mevent.Event, text string) {
+func (h *Handler) sendReaction(ctx context.Context, event *mevent.Event, reaction string) {
+	if err := h.sender.SendReaction(ctx, event.RoomID, event.ID, reaction); err != nil {
+		zerolog.Ctx(ctx).Error().Err(err).Msgf("Failed to react with %s", reaction)
+	}
+}
+
+func (h *Handler) sendMarkdown(ctx context.Context, event *mevent.Event, text string) {
 	content := format.RenderMarkdown(text, true, false)
-	SendMessage(event.RoomID, &content)
+	h.sender.SendMessage(ctx, event.RoomID, &content)
 }
 
-func sendReply(event *mevent.Event, text string) {
+func (h *Handler) sendReply(ctx context.Context, event *mevent.Event, text string) {
 	content := mevent.MessageEventContent{
 		MsgType: mevent.MsgText,
 		Body:    text,
@@ -124,20 +264,25 @@ func sendReply(event *mevent.Event, text string) {
 		},
 	}
 
-	SendMessage(event.RoomID, &content)
+	h.sender.SendMessage(ctx, event.RoomID, &content)
 }
 
-func sendMessage(event *mevent.Event, text string) {
+func (h *Handler) sendMessage(ctx context.Context, event *mevent.Event, text string) {
 	content := mevent.MessageEventContent{
 		MsgType: mevent.MsgText,
 		Body:    text,
 	}
 
-	SendMessage(event.RoomID, &content)
+	h.sender.SendMessage(ctx, event.RoomID, &content)
 }
 
-func sendImage(event *mevent.Event, filename string, imageBytes []byte) {
-	var file *attachment.EncryptedFile
+func (h *Handler) sendImage(ctx context.Context, event *mevent.Event, filename string, imageBytes []byte) {
+	h.sendCaptionedImage(ctx, event, filename, "", imageBytes)
+}
+
+// sendCaptionedImage sends an image with a caption, which clients show
+// instead of the filename.
+func (h *Handler) sendCaptionedImage(ctx context.Context, event *mevent.Event, filename, caption string, imageBytes []byte) {
 	cfg, _, _ := image.DecodeConfig(bytes.NewReader(imageBytes))
 
 	content := &mevent.MessageEventContent{
@@ -158,35 +303,115 @@ func sendImage(event *mevent.Event, filename string, imageBytes []byte) {
 		},
 	}
 
+	if caption != "" {
+		content.Body, content.FileName = caption, filename
+	}
+
+	h.sendAttachment(ctx, event, content, imageBytes)
+}
+
+func (h *Handler) sendFile(ctx context.Context, event *mevent.Event, filename, mimeType string, fileBytes []byte) {
+	content := &mevent.MessageEventContent{
+		MsgType: mevent.MsgFile,
+		Body:    filename,
+		Info: &mevent.FileInfo{
+			MimeType: mimeType,
+			Size:     len(fileBytes),
+		},
+
+		RelatesTo: &mevent.RelatesTo{
+			EventID: event.ID,
+			InReplyTo: &mevent.InReplyTo{
+				EventID: event.ID,
+			},
+		},
+	}
+
+	h.sendAttachment(ctx, event, content, fileBytes)
+}
+
+// sendAttachment uploads the data, encrypting it first if the room is
+// encrypted, and sends the message content referring to it.
+func (h *Handler) sendAttachment(ctx context.Context, event *mevent.Event, content *mevent.MessageEventContent, data []byte) {
+	logger := zerolog.Ctx(ctx)
+	var file *attachment.EncryptedFile
 	uploadMime := content.Info.MimeType
-	isEncrypted, err := Bot.stateStore.IsEncrypted(context.Background(), event.RoomID)
+	isEncrypted, err := h.store.IsEncrypted(ctx, event.RoomID)
 	if err != nil {
-		log.Error().Err(err).Msg("Error checking if the state store is encrypted")
+		logger.Error().Err(err).Msg("Error checking if the state store is encrypted")
 		return
 	}
 	if isEncrypted {
 		file = attachment.NewEncryptedFile()
-		file.EncryptInPlace(imageBytes)
+		file.EncryptInPlace(data)
 		uploadMime = "application/octet-stream"
 	}
 
-	req := mautrix.ReqUploadMedia{
-		ContentBytes: imageBytes,
-		ContentType:  uploadMime,
-	}
-
-	upload, err := Bot.client.UploadMedia(context.Background(), req)
+	uri, err := h.sender.UploadMedia(ctx, data, uploadMime)
 	if err != nil {
-		log.Error().Err(err).Msg("Failed to upload media")
+		logger.Error().Err(err).Msg("Failed to upload media")
+		return
 	}
 
 	if file != nil {
 		content.File = &mevent.EncryptedFileInfo{
 			EncryptedFile: *file,
-			URL:           upload.ContentURI.CUString(),
+			URL:           uri,
 		}
 	} else {
-		content.URL = upload.ContentURI.CUString()
+		content.URL = uri
+	}
+	h.sender.SendMessage(ctx, event.RoomID, content)
+}
+
+// repliedImage fetches the image that a command replies to. The sender is told
+// how to use the command when it doesn't reply to an image.
+func (h *Handler) repliedImage(ctx context.Context, event *mevent.Event, content *mevent.MessageEventContent, usage string) (*mevent.Event, []byte, bool) {
+	replyTo := content.GetReplyTo()
+	if replyTo == "" {
+		h.sendMarkdown(ctx, event, usage)
+		return nil, nil, false
+	}
+	target, data, err := h.fetchImage(ctx, event.RoomID, replyTo)
+	if errors.Is(err, errNotAnImage) {
+		h.sendMarkdown(ctx, event, usage)
+		return nil, nil, false
+	} else if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Msgf("Couldn't fetch the image of %s", replyTo)
+		h.sendReply(ctx, event, "Couldn't get the image you replied to")
+		return nil, nil, false
+	}
+	return target, data, true
+}
+
+// errNotAnImage is returned by fetchImage for events without an image.
+var errNotAnImage = errors.New("not an image")
+
+// fetchImage fetches an image message, or a file message with an image, and
+// downloads and decrypts its image.
+func (h *Handler) fetchImage(ctx context.Context, roomID mid.RoomID, eventID mid.EventID) (*mevent.Event, []byte, error) {
+	event, err := h.sender.GetEvent(ctx, roomID, eventID)
+	if err != nil {
+		return nil, nil, err
+	}
+	content := event.Content.AsMessage()
+	isImageFile := content.MsgType == mevent.MsgFile && content.Info != nil && strings.HasPrefix(content.Info.MimeType, "image/")
+	if event.Type != mevent.EventMessage || (content.MsgType != mevent.MsgImage && !isImageFile) {
+		return event, nil, errNotAnImage
+	}
+
+	uri := content.URL
+	if content.File != nil {
+		uri = content.File.URL
+	}
+	data, err := h.sender.DownloadMedia(ctx, uri)
+	if err != nil {
+		return event, nil, err
+	}
+	if content.File != nil {
+		if err := content.File.DecryptInPlace(data); err != nil {
+			return event, nil, err
+		}
 	}
-	SendMessage(event.RoomID, content)
+	return event, data, nil
 }
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image/png"
+	"strings"
+	"testing"
+	"time"
+
+	"maunium.net/go/mautrix"
+	mevent "maunium.net/go/mautrix/event"
+	mid "maunium.net/go/mautrix/id"
+)
+
+const (
+	testAlice = mid.UserID("@alice:example.com")
+	testBob   = mid.UserID("@bob:example.com")
+	testRoom  = mid.RoomID("!room:example.com")
+)
+
+// reactions returns the keys of the reactions among events.
+func reactions(events []*mevent.Event) []string {
+	var keys []string
+	for _, event := range events {
+		if event.Type == mevent.EventReaction {
+			keys = append(keys, event.Content.AsReaction().RelatesTo.Key)
+		}
+	}
+	return keys
+}
+
+// messages returns the messages among events, decrypting them if needed.
+func (tb *testBot) messages(t *testing.T, events []*mevent.Event) []*mevent.MessageEventContent {
+	var messages []*mevent.MessageEventContent
+	for _, event := range events {
+		if event.Type == mevent.EventEncrypted {
+			event = tb.decrypt(t, event)
+		}
+		if event.Type == mevent.EventMessage {
+			messages = append(messages, event.Content.AsMessage())
+		}
+	}
+	return messages
+}
+
+func TestPing(t *testing.T) {
+	tb := newTestBot(t, false, nil)
+	tb.createRoom(testRoom, false, testAlice, testBob)
+
+	messages := tb.messages(t, tb.handle(testRoom, testAlice, "ping"))
+	if len(messages) != 1 || messages[0].Body != "pong" {
+		t.Fatalf("expected a pong, got %+v", messages)
+	}
+	if messages[0].RelatesTo.GetReplyTo() == "" {
+		t.Error("expected the pong to be a reply")
+	}
+}
+
+func TestGenerateImage(t *testing.T) {
+	for _, encrypted := range []bool{false, true} {
+		name := "unencrypted"
+		if encrypted {
+			name = "encrypted"
+		}
+		t.Run(name, func(t *testing.T) {
+			tb := newTestBot(t, encrypted, nil)
+			tb.createRoom(testRoom, encrypted, testAlice, testBob)
+
+			sent := tb.handle(testRoom, testAlice, "!gen a lighthouse at dusk w:640 h:384")
+
+			if len(tb.image.requests) != 1 {
+				t.Fatalf("expected 1 txt2img request, got %d", len(tb.image.requests))
+			}
+			request := tb.image.requests[0]
+			if request.Prompt != "a lighthouse at dusk" || request.Width != 640 || request.Height != 384 {
+				t.Errorf("unexpected txt2img request %+v", request)
+			}
+
+			if got := strings.Join(reactions(sent), " "); got != "👌 ✔️" {
+				t.Errorf("expected the 👌 and ✔️ reactions, got %s", got)
+			}
+			messages := tb.messages(t, sent)
+			if len(messages) != 1 || messages[0].MsgType != mevent.MsgImage {
+				t.Fatalf("expected an image, got %+v", messages)
+			}
+			content := messages[0]
+			if content.Info.Width != 640 || content.Info.Height != 384 || content.Info.MimeType != "image/png" {
+				t.Errorf("unexpected image info %+v", content.Info)
+			}
+
+			var data []byte
+			if encrypted {
+				if content.File == nil || content.URL != "" {
+					t.Fatal("expected the image to be uploaded encrypted")
+				}
+				data = tb.hs.download(content.File.URL)
+				if err := content.File.DecryptInPlace(data); err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				data = tb.hs.download(content.URL)
+			}
+			if _, err := png.DecodeConfig(bytes.NewReader(data)); err != nil {
+				t.Errorf("the uploaded image isn't a PNG: %s", err)
+			}
+		})
+	}
+}
+
+func TestGenerateImageFailure(t *testing.T) {
+	tb := newTestBot(t, false, nil)
+	tb.createRoom(testRoom, false, testAlice, testBob)
+	tb.image.fail = true
+
+	sent := tb.handle(testRoom, testAlice, "!gen a lighthouse")
+	if got := strings.Join(reactions(sent), " "); got != "👌 ❌" {
+		t.Errorf("expected the 👌 and ❌ reactions, got %s", got)
+	}
+	if messages := tb.messages(t, sent); len(messages) != 1 || messages[0].MsgType != mevent.MsgText {
+		t.Errorf("expected an apology, got %+v", messages)
+	}
+	usage, err := Bot.stateStore.ListUsage(context.Background(), time.Time{})
+	if err != nil || len(usage) != 1 || !strings.Contains(usage[0].Error, "500 Internal Server Error: out of memory") {
+		t.Errorf("expected the status and body of the response in the ledger, got %+v, %v", usage, err)
+	}
+}
+
+func TestChat(t *testing.T) {
+	tb := newTestBot(t, false, nil)
+	// With only one other member, every message is for the bot
+	tb.createRoom(testRoom, false, testAlice)
+
+	messages := tb.messages(t, tb.handle(testRoom, testAlice, "how are you?"))
+	if len(messages) != 1 || messages[0].Body != "Hello there!" {
+		t.Fatalf("expected the backend's reply, got %+v", messages)
+	}
+
+	if len(tb.chat.requests) != 1 {
+		t.Fatalf("expected 1 chat request, got %d", len(tb.chat.requests))
+	}
+	sentMessages := tb.chat.requests[0].Messages
+	if last := sentMessages[len(sentMessages)-1]; !strings.Contains(last.Content, "how are you?") {
+		t.Errorf("expected the prompt to be sent, got %+v", last)
+	}
+	if history := tb.account.txt2txt.Histories[testRoom.String()]; len(history) == 0 || history[len(history)-1].Content != "Hello there!" {
+		t.Errorf("expected the reply in the history, got %+v", history)
+	}
+}
+
+func TestChatIgnoresGroupChatter(t *testing.T) {
+	tb := newTestBot(t, false, nil)
+	tb.createRoom(testRoom, false, testAlice, testBob)
+
+	if sent := tb.handle(testRoom, testAlice, "how are you?"); len(sent) != 0 {
+		t.Errorf("expected the bot to stay quiet, got %d events", len(sent))
+	}
+	if len(tb.chat.requests) != 0 {
+		t.Errorf("expected no chat requests, got %d", len(tb.chat.requests))
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	tb := newTestBot(t, false, func(config *Configuration) {
+		config.Limits.User = LimitSettings{Burst: 1}
+	})
+	tb.createRoom(testRoom, false, testAlice, testBob)
+
+	tb.handle(testRoom, testAlice, "!gen a lighthouse")
+	messages := tb.messages(t, tb.handle(testRoom, testAlice, "!gen another lighthouse"))
+	if len(messages) != 1 || !strings.Contains(messages[0].Body, "rate limit") {
+		t.Errorf("expected the second request to be refused, got %+v", messages)
+	}
+	if len(tb.image.requests) != 1 {
+		t.Errorf("expected 1 txt2img request, got %d", len(tb.image.requests))
+	}
+}
+
+// TestSync drives the bot through the fake homeserver's sync, from the room
+// state to the reply.
+func TestSync(t *testing.T) {
+	tb := newTestBot(t, false, nil)
+
+	syncer := tb.account.client.Syncer.(*mautrix.DefaultSyncer)
+	syncer.OnEvent(Bot.stateStore.UpdateState)
+	syncer.OnEventType(mevent.EventMessage, func(ctx context.Context, event *mevent.Event) {
+		handleInBackground(ctx, event, tb.account.handler.HandleMessage)
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		tb.account.client.SyncWithContext(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			t.Error("the sync didn't stop")
+		}
+	}()
+
+	tb.hs.createRoom(testRoom, testAlice, testBob)
+	tb.hs.queue(tb.hs.textMessage(testRoom, testAlice, "ping"))
+
+	messages := tb.messages(t, tb.hs.waitForSent(1))
+	if len(messages) != 1 || messages[0].Body != "pong" {
+		t.Fatalf("expected a pong, got %+v", messages)
+	}
+	if !Bot.stateStore.IsInRoom(ctx, testRoom, testBob) {
+		t.Error("expected the room members to be stored from the sync")
+	}
+}
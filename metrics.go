@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog/log"
+	"maunium.net/go/mautrix"
+)
+
+var (
+	syncsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bot_syncs_total",
+		Help: "Sync requests to the homeserver by account and result (ok or error).",
+	}, []string{"account", "result"})
+	lastSyncTime = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "bot_last_sync_timestamp_seconds",
+		Help: "When the last successful sync of an account finished.",
+	}, []string{"account"})
+
+	messagesHandled = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bot_messages_handled_total",
+		Help: "Messages the bot acted on, by command.",
+	}, []string{"command"})
+
+	jobDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "bot_job_duration_seconds",
+		Help:    "How long txt2img and txt2txt jobs took, by kind and backend.",
+		Buckets: prometheus.ExponentialBuckets(0.5, 2, 10),
+	}, []string{"kind", "backend"})
+	jobFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bot_job_failures_total",
+		Help: "Jobs that failed, by kind and backend.",
+	}, []string{"kind", "backend"})
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "bot_active_jobs",
+		Help: "Jobs that are currently running.",
+	}, func() float64 { return float64(len(ActiveJobs())) })
+	tokensConsumed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bot_tokens_total",
+		Help: "LLM tokens consumed, by type (prompt or completion).",
+	}, []string{"type"})
+	imagesGenerated = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "bot_images_generated_total",
+		Help: "Images generated.",
+	})
+
+	decryptionFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bot_decryption_failures_total",
+		Help: "Events that couldn't be decrypted, by reason (no_session, timeout or error).",
+	}, []string{"reason"})
+	retries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bot_retries_total",
+		Help: "Failed attempts that DoRetry retried, by operation.",
+	}, []string{"operation"})
+)
+
+// observeSync records the result of a sync request of the account.
+func (a *Account) observeSync(err error) {
+	account := a.client.UserID.String()
+	if err != nil {
+		syncsTotal.WithLabelValues(account, "error").Inc()
+		if errors.Is(err, mautrix.MUnknownToken) {
+			a.loginLost.Store(true)
+		}
+		return
+	}
+	syncsTotal.WithLabelValues(account, "ok").Inc()
+	lastSyncTime.WithLabelValues(account).SetToCurrentTime()
+	a.lastSync.Store(time.Now().UnixNano())
+}
+
+// observeJob records the duration and outcome of a finished job.
+func observeJob(job *Job, usage Usage, images int, err error) {
+	jobDuration.WithLabelValues(job.Kind, job.Backend).Observe(time.Since(job.Started).Seconds())
+	if err != nil {
+		jobFailures.WithLabelValues(job.Kind, job.Backend).Inc()
+	}
+	tokensConsumed.WithLabelValues("prompt").Add(float64(usage.PromptTokens))
+	tokensConsumed.WithLabelValues("completion").Add(float64(usage.CompletionTokens))
+	imagesGenerated.Add(float64(images))
+}
+
+// startHTTPServer serves the metrics and the health checks on the given
+// address in the background.
+func startHTTPServer(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/healthz", healthHandler(func(_ context.Context, report *healthReport) { checkLiveness(report) }))
+	mux.Handle("/readyz", healthHandler(checkReadiness))
+
+	server := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		log.Info().Msgf("Serving metrics and health checks on %s", addr)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error().Err(err).Msgf("The HTTP listener on %s failed", addr)
+		}
+	}()
+	return server
+}
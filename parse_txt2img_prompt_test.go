@@ -4,8 +4,6 @@ import (
 	"encoding/json"
 	"reflect"
 	"testing"
-
-	"github.com/rs/zerolog/log"
 )
 
 func TestParseTxt2ImgPrompt(t *testing.T) {
@@ -21,13 +19,14 @@ func TestParseTxt2ImgPrompt(t *testing.T) {
 			name: "a basic prompt with negatives and some configuration",
 			args: args{"some happy prompt h:512 w:600 ### not this tho cfg:12.3 ds:.6 hr:1 sampler:ddim"},
 			want: txt2img_request{
-				HRUpscaler:        "Latent",
+				HRUpscaler:        "4x_Valar_v1",
 				Prompt:            "some happy prompt",
 				NegativePrompt:    "not this tho",
 				CfgScale:          12.3,
 				DenoisingStrength: 0.6,
 				EnableHR:          true,
 				SamplerName:       "DDIM",
+				Steps:             20,
 				Height:            512,
 				Width:             640, // rounded to multiple of 64
 			},
@@ -36,7 +35,7 @@ func TestParseTxt2ImgPrompt(t *testing.T) {
 			name: "a prompt with invalid values",
 			args: args{"w:g cfg:31 h:0 w:3000 steps:1000 count:10 sampler:foobar ds:2"},
 			want: txt2img_request{
-				// sampler ignored
+				EnableHR: true, HRUpscaler: "4x_Valar_v1", SamplerName: "Restart", // sampler ignored
 				DenoisingStrength: 1, CfgScale: 30, Width: 768, Height: 64, NIter: 9, Steps: 150, // clamped
 			},
 		},
@@ -44,18 +43,27 @@ func TestParseTxt2ImgPrompt(t *testing.T) {
 			name: "a prompt with weights",
 			args: args{"w:704 a (high:1.4) (low:0.3) prompt h:704"},
 			want: txt2img_request{
+				EnableHR: true, HRUpscaler: "4x_Valar_v1", SamplerName: "Restart", Steps: 20, DenoisingStrength: 0.7,
 				Prompt: "a (high:1.4) (low:0.3) prompt", //hasn't removed h: or w:
 				Width:  704,                             // hasn't tried to set it from low:
 				Height: 704,                             // hasn't tried to set it from high:
 			},
 		},
+		{
+			name: "a prompt with values that aren't valid regular expressions",
+			args: args{"a cat cfg:( steps:[ w:(1,2 ### ugly sampler:*"},
+			want: txt2img_request{
+				EnableHR: true, HRUpscaler: "4x_Valar_v1", SamplerName: "Restart", Steps: 20, DenoisingStrength: 0.7,
+				Prompt: "a cat", NegativePrompt: "ugly", Width: 512, Height: 512,
+			},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			got, _ := json.Marshal(ParsePromptForTxt2Img(tt.args.prompt))
 			want, _ := json.Marshal(tt.want)
 			if !reflect.DeepEqual(string(got), string(want)) {
-				log.Error().Msgf("ParsePrompt() = %v, want %v", string(got), string(want))
+				t.Errorf("ParsePrompt() = %v, want %v", string(got), string(want))
 			}
 		})
 	}
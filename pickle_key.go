@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+	"go.mau.fi/util/dbutil"
+	"maunium.net/go/mautrix/crypto/goolm/cipher"
+)
+
+// legacyPickleKey is the key that encrypted the crypto store before it became
+// configurable. It is only used for stores that haven't been migrated yet.
+const legacyPickleKey = "standupbot_cryptostore_key"
+
+// pickledColumns are the columns of the crypto store that hold data encrypted
+// with the pickle key.
+var pickledColumns = []struct {
+	table  string
+	column string
+}{
+	{"crypto_account", "account"},
+	{"crypto_olm_session", "session"},
+	{"crypto_megolm_inbound_session", "session"},
+	{"crypto_megolm_outbound_session", "session"},
+	{"crypto_secrets", "secret"},
+}
+
+// pickleKey returns the key that encrypts the Olm and Megolm sessions in the
+// crypto store.
+func pickleKey(config *Configuration) []byte {
+	if config.PickleKey == "" {
+		log.Warn().Msg("No pickle_key is configured, so the crypto store is encrypted with the well-known legacy key. " +
+			"Configure one and run the bot once with -rekey-crypto-store to migrate.")
+		return []byte(legacyPickleKey)
+	}
+	return []byte(config.PickleKey)
+}
+
+// rekeyCryptoStore decrypts every pickled session in the crypto store with the
+// old key and encrypts it again with the new one. Nothing is changed unless
+// every row could be migrated.
+func rekeyCryptoStore(ctx context.Context, db *sql.DB, dialect dbutil.Dialect, oldKey, newKey []byte) (int, error) {
+	// Not every table has a primary key, so rows are found by their physical ID
+	rowIDColumn := "rowid"
+	if dialect == dbutil.Postgres {
+		rowIDColumn = "ctid"
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	migrated := 0
+	for _, c := range pickledColumns {
+		rows, err := tx.QueryContext(ctx, fmt.Sprintf("SELECT %s, %s FROM %s", rowIDColumn, c.column, c.table))
+		if err != nil {
+			return 0, fmt.Errorf("couldn't read %s: %w", c.table, err)
+		}
+
+		type row struct {
+			rowID   any
+			pickled []byte
+		}
+		var pending []row
+		for rows.Next() {
+			var r row
+			if err := rows.Scan(&r.rowID, &r.pickled); err != nil {
+				rows.Close()
+				return 0, err
+			}
+			// Postgres returns a ctid as text, which it only takes back as a string
+			if rowID, ok := r.rowID.([]byte); ok {
+				r.rowID = string(rowID)
+			}
+			if len(r.pickled) > 0 {
+				pending = append(pending, r)
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return 0, err
+		}
+
+		update := fmt.Sprintf("UPDATE %s SET %s = $1 WHERE %s = $2", c.table, c.column, rowIDColumn)
+		for _, r := range pending {
+			plaintext, err := cipher.Unpickle(oldKey, r.pickled)
+			if err != nil {
+				return 0, fmt.Errorf("couldn't decrypt a row of %s with the old key: %w", c.table, err)
+			}
+			repickled, err := cipher.Pickle(newKey, plaintext)
+			if err != nil {
+				return 0, err
+			}
+			if _, err := tx.ExecContext(ctx, update, repickled, r.rowID); err != nil {
+				return 0, err
+			}
+			migrated++
+		}
+	}
+
+	return migrated, tx.Commit()
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"go.mau.fi/util/dbutil"
+	mcrypto "maunium.net/go/mautrix/crypto"
+	mid "maunium.net/go/mautrix/id"
+)
+
+func TestRekeyCryptoStore(t *testing.T) {
+	ctx := context.Background()
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	defer db.Close()
+
+	openStore := func(key string) *mcrypto.SQLCryptoStore {
+		utilDb, err := dbutil.NewWithDB(db, "sqlite3")
+		if err != nil {
+			t.Fatal(err)
+		}
+		cryptoStore := mcrypto.NewSQLCryptoStore(utilDb, nil, "@bot:example.com", mid.DeviceID("DEVICE"), []byte(key))
+		if err := cryptoStore.DB.Upgrade(ctx); err != nil {
+			t.Fatal(err)
+		}
+		return cryptoStore
+	}
+
+	oldStore := openStore(legacyPickleKey)
+	account := mcrypto.NewOlmAccount()
+	if err := oldStore.PutAccount(ctx, account); err != nil {
+		t.Fatal(err)
+	}
+	if err := oldStore.PutSecret(ctx, mid.SecretMegolmBackupV1, "backup key"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := rekeyCryptoStore(ctx, db, dbutil.SQLite, []byte("wrong key"), []byte("new key")); err == nil {
+		t.Fatal("rekeying with the wrong old key succeeded")
+	}
+	migrated, err := rekeyCryptoStore(ctx, db, dbutil.SQLite, []byte(legacyPickleKey), []byte("new key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if migrated != 2 {
+		t.Errorf("migrated %d rows, want 2", migrated)
+	}
+
+	newStore := openStore("new key")
+	loaded, err := newStore.GetAccount(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded == nil || loaded.IdentityKey() != account.IdentityKey() {
+		t.Errorf("account wasn't re-encrypted with the new key")
+	}
+	if secret, err := newStore.GetSecret(ctx, mid.SecretMegolmBackupV1); err != nil || secret != "backup key" {
+		t.Errorf("GetSecret() = %q, %v", secret, err)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+
+	"github.com/rs/zerolog"
+	mevent "maunium.net/go/mautrix/event"
+	mid "maunium.net/go/mautrix/id"
+)
+
+// displayName returns the name a user goes by in a room. It comes from the
+// state store, which sync keeps up to date; the member event is only fetched
+// for users the store hasn't seen yet.
+func (h *Handler) displayName(ctx context.Context, roomID mid.RoomID, userID mid.UserID) string {
+	member, err := h.store.TryGetMember(ctx, roomID, userID)
+	if err != nil {
+		zerolog.Ctx(ctx).Error().Err(err).Msgf("Failed to look up %s in %s", userID, roomID)
+	}
+
+	if member == nil {
+		var content mevent.MemberEventContent
+		if err := h.sender.StateEvent(ctx, roomID, mevent.StateMember, userID.String(), &content); err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Msgf("Failed to fetch the member event of %s in %s", userID, roomID)
+		} else {
+			member = &content
+			if err := h.store.SetMember(ctx, roomID, userID, member); err != nil {
+				zerolog.Ctx(ctx).Error().Err(err).Msgf("Failed to store %s in %s", userID, roomID)
+			}
+		}
+	}
+
+	if member != nil && member.Displayname != "" {
+		return member.Displayname
+	}
+	return userID.Localpart()
+}
+
+// isDirectChat returns whether the bot and one other user are the only
+// members of a room.
+func (h *Handler) isDirectChat(ctx context.Context, roomID mid.RoomID) bool {
+	members, err := h.store.GetRoomJoinedOrInvitedMembers(ctx, roomID)
+	if err != nil {
+		zerolog.Ctx(ctx).Error().Err(err).Msgf("Failed to get the members of %s", roomID)
+		return false
+	}
+	return len(members) == 2
+}
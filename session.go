@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bot/store"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+	"maunium.net/go/mautrix"
+	mid "maunium.net/go/mautrix/id"
+)
+
+// login authenticates the client. It reuses the session saved by a previous
+// run, then tries the configured access token and finally falls back to a
+// password login. The session that worked is saved for the next run.
+func login(ctx context.Context, client *mautrix.Client, config *AccountConfig, db *sql.DB) error {
+	username := mid.UserID(config.Username)
+
+	saved, err := Bot.stateStore.LoadSession(ctx, username)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to load the saved session")
+	}
+	// A newly configured access token takes precedence over the saved one
+	if saved != nil && (config.AccessToken == "" || config.AccessToken == saved.AccessToken) {
+		err := useAccessToken(ctx, client, username, saved.AccessToken)
+		if err == nil {
+			log.Info().Msgf("Restored the saved session for %s/%s", client.UserID, client.DeviceID)
+			return nil
+		}
+		if !errors.Is(err, mautrix.MUnknownToken) {
+			return fmt.Errorf("couldn't check the saved session: %w", err)
+		}
+		log.Warn().Err(err).Msg("The saved access token was rejected")
+		if err := Bot.stateStore.DeleteSession(ctx, username); err != nil {
+			log.Warn().Err(err).Msg("Failed to delete the saved session")
+		}
+	}
+
+	if config.AccessToken != "" {
+		err := useAccessToken(ctx, client, username, config.AccessToken)
+		if errors.Is(err, mautrix.MUnknownToken) {
+			return fmt.Errorf("the configured access token was rejected: %w", err)
+		} else if err != nil {
+			return fmt.Errorf("couldn't check the configured access token: %w", err)
+		}
+		log.Info().Msgf("Logged in with the configured access token as %s/%s", client.UserID, client.DeviceID)
+		return saveSession(ctx, client)
+	}
+
+	deviceID := FindDeviceID(db, username.String())
+	if saved != nil {
+		deviceID = saved.DeviceID
+	}
+	if len(deviceID) > 0 {
+		log.Info().Msgf("'Found existing device ID in database: %s", deviceID)
+	}
+
+	_, err = DoRetry("login", func() (interface{}, error) {
+		return client.Login(ctx, &mautrix.ReqLogin{
+			Type: mautrix.AuthTypePassword,
+			Identifier: mautrix.UserIdentifier{
+				Type: mautrix.IdentifierTypeUser,
+				User: username.String(),
+			},
+			Password:                 config.Password,
+			InitialDeviceDisplayName: config.DisplayName,
+			DeviceID:                 deviceID,
+			StoreCredentials:         true,
+		})
+	})
+	if err != nil {
+		return err
+	}
+	log.Info().Msgf("Logged in with a password as %s/%s", client.UserID, client.DeviceID)
+	return saveSession(ctx, client)
+}
+
+// useAccessToken configures the client with an existing access token and
+// checks that it belongs to the expected user.
+func useAccessToken(ctx context.Context, client *mautrix.Client, username mid.UserID, accessToken string) error {
+	client.AccessToken = accessToken
+	var whoami *mautrix.RespWhoami
+	var rejected error
+	_, err := DoRetry("whoami", func() (interface{}, error) {
+		var err error
+		whoami, err = client.Whoami(ctx)
+		if errors.Is(err, mautrix.MUnknownToken) {
+			// Asking again won't change the homeserver's mind
+			rejected = err
+			return nil, nil
+		}
+		return whoami, err
+	})
+	if rejected != nil {
+		err = rejected
+	}
+	if err != nil {
+		client.AccessToken = ""
+		return err
+	}
+	if whoami.UserID != username {
+		client.AccessToken = ""
+		return fmt.Errorf("the access token belongs to %s instead of %s", whoami.UserID, username)
+	}
+	if whoami.DeviceID == "" {
+		client.AccessToken = ""
+		return errors.New("the homeserver didn't say which device the access token belongs to")
+	}
+	client.UserID = whoami.UserID
+	client.DeviceID = whoami.DeviceID
+	return nil
+}
+
+func saveSession(ctx context.Context, client *mautrix.Client) error {
+	return Bot.stateStore.SaveSession(ctx, &store.Session{
+		UserID:      client.UserID,
+		DeviceID:    client.DeviceID,
+		AccessToken: client.AccessToken,
+	})
+}
+
+// cryptoAccountTables are the tables of the crypto store that hold an
+// account's own device: its Olm account and sessions and its Megolm sessions.
+var cryptoAccountTables = []string{
+	"crypto_account",
+	"crypto_olm_session",
+	"crypto_megolm_inbound_session",
+	"crypto_megolm_outbound_session",
+}
+
+// logout invalidates the access token of the saved session and forgets the
+// session and the device's encryption keys, so that the next start creates a
+// fresh device. Accounts without a saved session are left alone.
+func logout(ctx context.Context, config *AccountConfig, db *sql.DB) error {
+	username := mid.UserID(config.Username)
+	saved, err := Bot.stateStore.LoadSession(ctx, username)
+	if err != nil {
+		return fmt.Errorf("couldn't load the saved session: %w", err)
+	}
+	if saved == nil {
+		log.Info().Msgf("No session is saved for %s, there is nothing to log out", username)
+		return nil
+	}
+
+	client, err := mautrix.NewClient(config.Homeserver, username, saved.AccessToken)
+	if err != nil {
+		return err
+	}
+	client.DeviceID = saved.DeviceID
+	client.Log = log.Logger.With().Str("component", "matrix").Str("account", config.Username).Logger()
+	if _, err := client.Logout(ctx); err != nil && !errors.Is(err, mautrix.MUnknownToken) {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, table := range cryptoAccountTables {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM "+table+" WHERE account_id = $1", username.String()); err != nil {
+			return fmt.Errorf("couldn't delete from %s: %w", table, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if err := Bot.stateStore.DeleteSession(ctx, username); err != nil {
+		return err
+	}
+	log.Info().Msgf("Logged out %s/%s", username, saved.DeviceID)
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	mevent "maunium.net/go/mautrix/event"
+)
+
+// cancelledJobsGrace is how long cancelled jobs get to tell their users.
+const cancelledJobsGrace = 5 * time.Second
+
+// handleInBackground runs a message handler in its own goroutine, unless the
+// bot is shutting down. The handler doesn't inherit the cancellation of the
+// sync, so that it can finish while the bot drains.
+func handleInBackground(ctx context.Context, event *mevent.Event, handler func(context.Context, *mevent.Event)) {
+	Bot.handlersLock.Lock()
+	defer Bot.handlersLock.Unlock()
+	if Bot.shuttingDown {
+		log.Info().Msgf("Ignoring event %s because the bot is shutting down", event.ID)
+		return
+	}
+	Bot.handlers.Add(1)
+	go func() {
+		defer Bot.handlers.Done()
+		handler(context.WithoutCancel(ctx), event)
+	}()
+}
+
+// waitForHandlers waits until every running message handler has returned, or
+// the timeout passed. It returns whether they all returned.
+func waitForHandlers(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		Bot.handlers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// shutdown stops the bot after the sync has been stopped. Running jobs get
+// shutdown_timeout seconds to finish before they are cancelled, then the
+// histories and keys are saved and the database is closed.
+func shutdown(db *sql.DB) {
+	Bot.handlersLock.Lock()
+	Bot.shuttingDown = true
+	Bot.handlersLock.Unlock()
+
+	timeout := time.Duration(Bot.Config().ShutdownTimeout) * time.Second
+	if jobs := ActiveJobs(); len(jobs) > 0 {
+		log.Info().Msgf("Waiting up to %s for %d running jobs", timeout, len(jobs))
+	}
+	if !waitForHandlers(timeout) {
+		jobs := ActiveJobs()
+		log.Warn().Msgf("Cancelling %d jobs that are still running", len(jobs))
+		notifyDebugRoom(fmt.Sprintf("cancelling %d jobs to shut down", len(jobs)))
+		cancelActiveJobs()
+		if !waitForHandlers(cancelledJobsGrace) {
+			log.Warn().Msg("Some message handlers didn't return in time")
+		}
+	}
+
+	if Bot.httpServer != nil {
+		Bot.httpServer.Close()
+	}
+	for _, account := range Bot.accounts {
+		if err := account.txt2txt.SaveHistories(); err != nil {
+			log.Error().Err(err).Msgf("Failed to save the histories of %s", account.client.UserID)
+		}
+		if account.keyBackup != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), cancelledJobsGrace)
+			if err := account.keyBackup.Upload(ctx); err != nil {
+				log.Error().Err(err).Msgf("Failed to back up the latest room keys of %s", account.client.UserID)
+			}
+			cancel()
+		}
+	}
+	notifyDebugRoom("shutting down")
+
+	if err := db.Close(); err != nil {
+		log.Error().Err(err).Msg("Failed to close the database")
+	}
+	log.Info().Msg("Stopped")
+}
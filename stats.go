@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bot/store"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	mevent "maunium.net/go/mautrix/event"
+)
+
+const defaultStatsDays = 7
+
+// handleStats implements `!stats [user|room|day] [days:N]` and the admin only
+// `!stats export csv|json [days:N]`.
+func (h *Handler) handleStats(ctx context.Context, event *mevent.Event, args string) {
+	groupBy := store.GroupByUser
+	days := defaultStatsDays
+	daysGiven := false
+	export := ""
+
+	fields := strings.Fields(args)
+	for i := 0; i < len(fields); i++ {
+		field := fields[i]
+		switch {
+		case field == "user":
+			groupBy = store.GroupByUser
+		case field == "room":
+			groupBy = store.GroupByRoom
+		case field == "day":
+			groupBy = store.GroupByDay
+		case field == "export" && i+1 < len(fields):
+			i++
+			export = fields[i]
+		case strings.HasPrefix(field, "days:"):
+			if v, err := strconv.ParseInt(strings.TrimPrefix(field, "days:"), 10, 32); err == nil {
+				days = clamp(int(v), 1, 366)
+				daysGiven = true
+			}
+		default:
+			h.sendReply(ctx, event, "usage: !stats [user|room|day] [days:N] or !stats export csv|json [days:N]")
+			return
+		}
+	}
+
+	since := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, 1-days)
+
+	if export != "" || groupBy == store.GroupByRoom {
+		if !h.config().IsAdmin(event.Sender) {
+			h.sendReply(ctx, event, "Sorry, only admins can see usage across rooms.")
+			return
+		}
+	}
+
+	if export != "" {
+		// The export is the whole ledger unless it's limited to some days
+		if !daysGiven {
+			since = time.Time{}
+		}
+		h.exportUsage(ctx, event, export, since)
+		return
+	}
+
+	roomID := event.RoomID.String()
+	if groupBy == store.GroupByRoom {
+		roomID = ""
+	}
+	summaries, err := h.store.SummarizeUsage(ctx, since, roomID, groupBy)
+	if err != nil {
+		zerolog.Ctx(ctx).Error().Err(err).Msg("Failed to summarize usage")
+		h.sendReply(ctx, event, "Couldn't look up the stats")
+		return
+	}
+	if len(summaries) == 0 {
+		h.sendReply(ctx, event, fmt.Sprintf("Nothing has been generated in the last %d days.", days))
+		return
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "usage over the last %d days\n\n", days)
+	fmt.Fprintf(&sb, "| %s | jobs | failed | images | tokens | time |\n| --- | --- | --- | --- | --- | --- |\n", strings.TrimSuffix(groupBy, "_id"))
+	for _, s := range summaries {
+		fmt.Fprintf(&sb, "| %s | %d | %d | %d | %d | %s |\n",
+			s.Key, s.Jobs, s.Failures, s.Images, s.Tokens, s.Duration.Round(time.Second))
+	}
+	h.sendMarkdown(ctx, event, sb.String())
+}
+
+func (h *Handler) exportUsage(ctx context.Context, event *mevent.Event, format string, since time.Time) {
+	entries, err := h.store.ListUsage(ctx, since)
+	if err != nil {
+		zerolog.Ctx(ctx).Error().Err(err).Msg("Failed to list usage")
+		h.sendReply(ctx, event, "Couldn't export the usage ledger")
+		return
+	}
+
+	switch format {
+	case "json":
+		data, err := json.MarshalIndent(entries, "", "  ")
+		if err != nil {
+			zerolog.Ctx(ctx).Error().Err(err).Msg("Failed to marshal usage")
+			h.sendReply(ctx, event, "Couldn't export the usage ledger")
+			return
+		}
+		h.sendFile(ctx, event, "usage.json", "application/json", data)
+	case "csv":
+		var buf bytes.Buffer
+		w := csv.NewWriter(&buf)
+		w.Write([]string{"created_at", "user_id", "room_id", "kind", "backend", "model",
+			"prompt_tokens", "completion_tokens", "images", "duration_ms", "success", "error"})
+		for _, e := range entries {
+			w.Write([]string{
+				e.CreatedAt.UTC().Format(time.RFC3339), e.UserID, e.RoomID, e.Kind, e.Backend, e.Model,
+				strconv.Itoa(e.PromptTokens), strconv.Itoa(e.CompletionTokens), strconv.Itoa(e.Images),
+				strconv.FormatInt(e.Duration, 10), strconv.FormatBool(e.Success), e.Error,
+			})
+		}
+		w.Flush()
+		h.sendFile(ctx, event, "usage.csv", "text/csv", buf.Bytes())
+	default:
+		h.sendReply(ctx, event, "Usage can be exported as csv or json")
+	}
+}
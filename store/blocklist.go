@@ -0,0 +1,62 @@
+//
+// Users the bot ignores
+//
+
+package store
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	mid "maunium.net/go/mautrix/id"
+)
+
+type BlockedUser struct {
+	UserID    mid.UserID
+	BlockedBy mid.UserID
+	CreatedAt time.Time
+}
+
+func (store *StateStore) BlockUser(ctx context.Context, userID, blockedBy mid.UserID) error {
+	insert := "INSERT INTO blocked_users (user_id, blocked_by, created_at) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING"
+	_, err := store.DB.ExecContext(ctx, insert, userID, blockedBy, time.Now().UnixMilli())
+	return err
+}
+
+func (store *StateStore) UnblockUser(ctx context.Context, userID mid.UserID) error {
+	_, err := store.DB.ExecContext(ctx, "DELETE FROM blocked_users WHERE user_id = $1", userID)
+	return err
+}
+
+func (store *StateStore) IsBlocked(ctx context.Context, userID mid.UserID) (bool, error) {
+	row := store.DB.QueryRowContext(ctx, "SELECT 1 FROM blocked_users WHERE user_id = $1", userID)
+	var found int
+	if err := row.Scan(&found); err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (store *StateStore) ListBlocked(ctx context.Context) ([]BlockedUser, error) {
+	rows, err := store.DB.QueryContext(ctx, "SELECT user_id, blocked_by, created_at FROM blocked_users ORDER BY created_at")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := make([]BlockedUser, 0)
+	for rows.Next() {
+		var user BlockedUser
+		var createdAt int64
+		if err := rows.Scan(&user.UserID, &user.BlockedBy, &createdAt); err != nil {
+			return nil, err
+		}
+		user.CreatedAt = time.UnixMilli(createdAt)
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
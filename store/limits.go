@@ -0,0 +1,61 @@
+//
+// Persists rate limit buckets and daily quota usage
+//
+
+package store
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// LoadBucket returns the stored token count of a rate limit bucket and when it
+// was last updated. A bucket that has never been saved is reported as not found.
+func (store *StateStore) LoadBucket(ctx context.Context, scope, subject string) (tokens float64, updatedAt time.Time, found bool, err error) {
+	row := store.DB.QueryRowContext(ctx, "SELECT tokens, updated_at FROM rate_limit_buckets WHERE scope = $1 AND subject = $2", scope, subject)
+
+	var updated int64
+	if err = row.Scan(&tokens, &updated); err != nil {
+		if err == sql.ErrNoRows {
+			return 0, time.Time{}, false, nil
+		}
+		return 0, time.Time{}, false, err
+	}
+	return tokens, time.UnixMilli(updated), true, nil
+}
+
+func (store *StateStore) SaveBucket(ctx context.Context, scope, subject string, tokens float64, updatedAt time.Time) error {
+	log.Debug().Msgf("Upserting rate limit bucket %s/%s", scope, subject)
+	upsert := `
+		INSERT INTO rate_limit_buckets (scope, subject, tokens, updated_at) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (scope, subject) DO UPDATE SET tokens = excluded.tokens, updated_at = excluded.updated_at
+	`
+	_, err := store.DB.ExecContext(ctx, upsert, scope, subject, tokens, updatedAt.UnixMilli())
+	return err
+}
+
+// GetDailyUsage returns how many images and LLM tokens were used by a subject
+// on the given day (formatted as YYYY-MM-DD).
+func (store *StateStore) GetDailyUsage(ctx context.Context, scope, subject, day string) (images, tokens int, err error) {
+	row := store.DB.QueryRowContext(ctx, "SELECT images, tokens FROM daily_quotas WHERE scope = $1 AND subject = $2 AND day = $3", scope, subject, day)
+	if err = row.Scan(&images, &tokens); err != nil {
+		if err == sql.ErrNoRows {
+			return 0, 0, nil
+		}
+		return 0, 0, err
+	}
+	return images, tokens, nil
+}
+
+func (store *StateStore) AddDailyUsage(ctx context.Context, scope, subject, day string, images, tokens int) error {
+	upsert := `
+		INSERT INTO daily_quotas (scope, subject, day, images, tokens) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (scope, subject, day) DO UPDATE
+		SET images = daily_quotas.images + excluded.images, tokens = daily_quotas.tokens + excluded.tokens
+	`
+	_, err := store.DB.ExecContext(ctx, upsert, scope, subject, day, images, tokens)
+	return err
+}
@@ -0,0 +1,70 @@
+-- v0 -> v1: Initial schema
+-- Databases created before versioning already have these tables, hence IF NOT EXISTS
+
+CREATE TABLE IF NOT EXISTS user_filter_ids (
+	user_id    VARCHAR(255) PRIMARY KEY,
+	filter_id  VARCHAR(255)
+);
+
+CREATE TABLE IF NOT EXISTS user_batch_tokens (
+	user_id           VARCHAR(255) PRIMARY KEY,
+	next_batch_token  VARCHAR(255)
+);
+
+CREATE TABLE IF NOT EXISTS rooms (
+	room_id           VARCHAR(255) PRIMARY KEY,
+	encryption_event  VARCHAR(65535) NULL
+);
+
+CREATE TABLE IF NOT EXISTS room_members (
+	room_id  VARCHAR(255),
+	user_id  VARCHAR(255),
+	PRIMARY KEY (room_id, user_id)
+);
+
+CREATE TABLE IF NOT EXISTS rate_limit_buckets (
+	scope       VARCHAR(16),
+	subject     VARCHAR(255),
+	tokens      REAL,
+	updated_at  BIGINT,
+	PRIMARY KEY (scope, subject)
+);
+
+CREATE TABLE IF NOT EXISTS daily_quotas (
+	scope    VARCHAR(16),
+	subject  VARCHAR(255),
+	day      VARCHAR(10),
+	images   INTEGER NOT NULL DEFAULT 0,
+	tokens   INTEGER NOT NULL DEFAULT 0,
+	PRIMARY KEY (scope, subject, day)
+);
+
+CREATE TABLE IF NOT EXISTS usage_ledger (
+	created_at         BIGINT NOT NULL,
+	day                VARCHAR(10) NOT NULL,
+	user_id            VARCHAR(255) NOT NULL,
+	room_id            VARCHAR(255) NOT NULL,
+	kind               VARCHAR(32) NOT NULL,
+	backend            VARCHAR(255) NOT NULL,
+	model              VARCHAR(255) NOT NULL,
+	prompt_tokens      INTEGER NOT NULL DEFAULT 0,
+	completion_tokens  INTEGER NOT NULL DEFAULT 0,
+	images             INTEGER NOT NULL DEFAULT 0,
+	duration_ms        BIGINT NOT NULL DEFAULT 0,
+	success            BOOLEAN NOT NULL,
+	error              TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS usage_ledger_created_at_idx ON usage_ledger (created_at);
+
+CREATE TABLE IF NOT EXISTS blocked_users (
+	user_id     VARCHAR(255) PRIMARY KEY,
+	blocked_by  VARCHAR(255),
+	created_at  BIGINT
+);
+
+CREATE TABLE IF NOT EXISTS bot_sessions (
+	user_id       VARCHAR(255) PRIMARY KEY,
+	device_id     VARCHAR(255),
+	access_token  VARCHAR(255)
+);
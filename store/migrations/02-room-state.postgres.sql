@@ -0,0 +1,11 @@
+-- v1 -> v2: Keep member profiles and room names and topics
+ALTER TABLE room_members ADD COLUMN membership VARCHAR(16) NOT NULL DEFAULT 'join';
+ALTER TABLE room_members ADD COLUMN displayname TEXT NOT NULL DEFAULT '';
+ALTER TABLE room_members ADD COLUMN avatar_url TEXT NOT NULL DEFAULT '';
+
+ALTER TABLE rooms ADD COLUMN name TEXT NOT NULL DEFAULT '';
+ALTER TABLE rooms ADD COLUMN topic TEXT NOT NULL DEFAULT '';
+
+-- encryption_event used to hold the whole event, it now holds its content
+UPDATE rooms SET encryption_event = (encryption_event::json->'content')::text
+WHERE encryption_event IS NOT NULL AND encryption_event <> '';
@@ -0,0 +1,200 @@
+//
+// Implements the mautrix.StateStore interface on StateStore and keeps the
+// room names and topics
+//
+
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"maunium.net/go/mautrix"
+	mevent "maunium.net/go/mautrix/event"
+	mid "maunium.net/go/mautrix/id"
+)
+
+var _ mautrix.StateStore = (*StateStore)(nil)
+
+type RoomInfo struct {
+	RoomID mid.RoomID
+	Name   string
+	Topic  string
+}
+
+// UpdateState stores the state the bot cares about from a sync event. It is
+// meant to be registered with OnEvent on the syncer.
+func (store *StateStore) UpdateState(ctx context.Context, event *mevent.Event) {
+	if event.StateKey == nil {
+		return
+	}
+
+	var err error
+	switch content := event.Content.Parsed.(type) {
+	case *mevent.RoomNameEventContent:
+		err = store.SetRoomName(ctx, event.RoomID, content.Name)
+	case *mevent.TopicEventContent:
+		err = store.SetRoomTopic(ctx, event.RoomID, content.Topic)
+	default:
+		mautrix.UpdateStateStore(ctx, store, event)
+	}
+	if err != nil {
+		log.Warn().Err(err).Msgf("Failed to store %s in %s", event.Type.Type, event.RoomID)
+	}
+}
+
+func (store *StateStore) IsInRoom(ctx context.Context, roomID mid.RoomID, userID mid.UserID) bool {
+	return store.IsMembership(ctx, roomID, userID, mevent.MembershipJoin)
+}
+
+func (store *StateStore) IsInvited(ctx context.Context, roomID mid.RoomID, userID mid.UserID) bool {
+	return store.IsMembership(ctx, roomID, userID, mevent.MembershipInvite, mevent.MembershipJoin)
+}
+
+func (store *StateStore) IsMembership(ctx context.Context, roomID mid.RoomID, userID mid.UserID, allowedMemberships ...mevent.Membership) bool {
+	member, err := store.GetMember(ctx, roomID, userID)
+	if err != nil {
+		log.Error().Err(err).Msgf("Failed to get the membership of %s in %s", userID, roomID)
+		return false
+	}
+	for _, membership := range allowedMemberships {
+		if member.Membership == membership {
+			return true
+		}
+	}
+	return false
+}
+
+// GetMember returns a member of a room. Unknown users are reported as having
+// left.
+func (store *StateStore) GetMember(ctx context.Context, roomID mid.RoomID, userID mid.UserID) (*mevent.MemberEventContent, error) {
+	member, err := store.TryGetMember(ctx, roomID, userID)
+	if member == nil && err == nil {
+		member = &mevent.MemberEventContent{Membership: mevent.MembershipLeave}
+	}
+	return member, err
+}
+
+// TryGetMember returns a member of a room, or nil if the user is unknown.
+func (store *StateStore) TryGetMember(ctx context.Context, roomID mid.RoomID, userID mid.UserID) (*mevent.MemberEventContent, error) {
+	row := store.DB.QueryRowContext(ctx,
+		"SELECT membership, displayname, avatar_url FROM room_members WHERE room_id = $1 AND user_id = $2", roomID, userID)
+
+	var member mevent.MemberEventContent
+	if err := row.Scan(&member.Membership, &member.Displayname, &member.AvatarURL); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &member, nil
+}
+
+func (store *StateStore) SetMembership(ctx context.Context, roomID mid.RoomID, userID mid.UserID, membership mevent.Membership) error {
+	upsert := `
+		INSERT INTO room_members (room_id, user_id, membership) VALUES ($1, $2, $3)
+		ON CONFLICT (room_id, user_id) DO UPDATE SET membership = excluded.membership
+	`
+	_, err := store.DB.ExecContext(ctx, upsert, roomID, userID, membership)
+	return err
+}
+
+func (store *StateStore) SetMember(ctx context.Context, roomID mid.RoomID, userID mid.UserID, member *mevent.MemberEventContent) error {
+	upsert := `
+		INSERT INTO room_members (room_id, user_id, membership, displayname, avatar_url) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (room_id, user_id) DO UPDATE
+		SET membership = excluded.membership, displayname = excluded.displayname, avatar_url = excluded.avatar_url
+	`
+	_, err := store.DB.ExecContext(ctx, upsert, roomID, userID, member.Membership, member.Displayname, member.AvatarURL)
+	return err
+}
+
+// ClearCachedMembers forgets the members of a room with the given
+// memberships, or all of them if none are given.
+func (store *StateStore) ClearCachedMembers(ctx context.Context, roomID mid.RoomID, memberships ...mevent.Membership) error {
+	query := "DELETE FROM room_members WHERE room_id = $1"
+	params := []any{roomID}
+	if len(memberships) > 0 {
+		placeholders := make([]string, len(memberships))
+		for i, membership := range memberships {
+			placeholders[i] = "$" + strconv.Itoa(i+2)
+			params = append(params, membership)
+		}
+		query += fmt.Sprintf(" AND membership IN (%s)", strings.Join(placeholders, ", "))
+	}
+	_, err := store.DB.ExecContext(ctx, query, params...)
+	return err
+}
+
+func (store *StateStore) GetRoomJoinedOrInvitedMembers(ctx context.Context, roomID mid.RoomID) ([]mid.UserID, error) {
+	rows, err := store.DB.QueryContext(ctx,
+		"SELECT user_id FROM room_members WHERE room_id = $1 AND membership IN ('join', 'invite')", roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := make([]mid.UserID, 0)
+	for rows.Next() {
+		var userID mid.UserID
+		if err := rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+		users = append(users, userID)
+	}
+	return users, rows.Err()
+}
+
+func (store *StateStore) SetEncryptionEvent(ctx context.Context, roomID mid.RoomID, content *mevent.EncryptionEventContent) error {
+	contentJSON, err := json.Marshal(content)
+	if err != nil {
+		return err
+	}
+	return store.upsertRoomColumn(ctx, roomID, "encryption_event", string(contentJSON))
+}
+
+// SetPowerLevels does nothing, the bot doesn't use power levels.
+func (store *StateStore) SetPowerLevels(context.Context, mid.RoomID, *mevent.PowerLevelsEventContent) error {
+	return nil
+}
+
+// GetPowerLevels always returns nil, the bot doesn't keep power levels.
+func (store *StateStore) GetPowerLevels(context.Context, mid.RoomID) (*mevent.PowerLevelsEventContent, error) {
+	return nil, nil
+}
+
+func (store *StateStore) SetRoomName(ctx context.Context, roomID mid.RoomID, name string) error {
+	return store.upsertRoomColumn(ctx, roomID, "name", name)
+}
+
+func (store *StateStore) SetRoomTopic(ctx context.Context, roomID mid.RoomID, topic string) error {
+	return store.upsertRoomColumn(ctx, roomID, "topic", topic)
+}
+
+// GetRoomInfo returns the name and topic of a room. They are empty for rooms
+// that haven't been seen yet.
+func (store *StateStore) GetRoomInfo(ctx context.Context, roomID mid.RoomID) (*RoomInfo, error) {
+	row := store.DB.QueryRowContext(ctx, "SELECT name, topic FROM rooms WHERE room_id = $1", roomID)
+
+	info := &RoomInfo{RoomID: roomID}
+	if err := row.Scan(&info.Name, &info.Topic); err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	return info, nil
+}
+
+// upsertRoomColumn sets one column of a room's row. column must be a
+// constant, it is not escaped.
+func (store *StateStore) upsertRoomColumn(ctx context.Context, roomID mid.RoomID, column string, value any) error {
+	upsert := fmt.Sprintf(`
+		INSERT INTO rooms (room_id, %[1]s) VALUES ($1, $2)
+		ON CONFLICT (room_id) DO UPDATE SET %[1]s = excluded.%[1]s
+	`, column)
+	_, err := store.DB.ExecContext(ctx, upsert, roomID, value)
+	return err
+}
@@ -0,0 +1,46 @@
+//
+// Persists the bot's own access token and device ID
+//
+
+package store
+
+import (
+	"context"
+	"database/sql"
+
+	mid "maunium.net/go/mautrix/id"
+)
+
+type Session struct {
+	UserID      mid.UserID
+	DeviceID    mid.DeviceID
+	AccessToken string
+}
+
+// LoadSession returns the saved session of a user, or nil if there is none.
+func (store *StateStore) LoadSession(ctx context.Context, userID mid.UserID) (*Session, error) {
+	row := store.DB.QueryRowContext(ctx, "SELECT device_id, access_token FROM bot_sessions WHERE user_id = $1", userID)
+
+	session := &Session{UserID: userID}
+	if err := row.Scan(&session.DeviceID, &session.AccessToken); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return session, nil
+}
+
+func (store *StateStore) SaveSession(ctx context.Context, session *Session) error {
+	upsert := `
+		INSERT INTO bot_sessions (user_id, device_id, access_token) VALUES ($1, $2, $3)
+		ON CONFLICT (user_id) DO UPDATE SET device_id = excluded.device_id, access_token = excluded.access_token
+	`
+	_, err := store.DB.ExecContext(ctx, upsert, session.UserID, session.DeviceID, session.AccessToken)
+	return err
+}
+
+func (store *StateStore) DeleteSession(ctx context.Context, userID mid.UserID) error {
+	_, err := store.DB.ExecContext(ctx, "DELETE FROM bot_sessions WHERE user_id = $1", userID)
+	return err
+}
@@ -0,0 +1,220 @@
+package store_test
+
+import (
+	"bot/store"
+	"bot/store/storetest"
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/crypto"
+	mevent "maunium.net/go/mautrix/event"
+	mid "maunium.net/go/mautrix/id"
+)
+
+var (
+	_ crypto.StateStore = (*store.StateStore)(nil)
+	_ mautrix.SyncStore = (*store.StateStore)(nil)
+)
+
+const (
+	alice = mid.UserID("@alice:example.com")
+	bob   = mid.UserID("@bob:example.com")
+	room1 = mid.RoomID("!one:example.com")
+	room2 = mid.RoomID("!two:example.com")
+)
+
+func stateEvent(roomID mid.RoomID, evtType mevent.Type, stateKey string, content any) *mevent.Event {
+	event := &mevent.Event{
+		RoomID:   roomID,
+		Type:     evtType,
+		StateKey: &stateKey,
+		Content:  mevent.Content{Parsed: content},
+	}
+	event.Type.Class = mevent.StateEventType
+	return event
+}
+
+func sorted[T ~string](values []T) []T {
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+	return values
+}
+
+func TestStateStore(t *testing.T) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, ctx context.Context, s *store.StateStore)
+	}{
+		{"filter ID", func(t *testing.T, ctx context.Context, s *store.StateStore) {
+			if filterID, err := s.LoadFilterID(ctx, alice); err != nil || filterID != "" {
+				t.Fatalf("expected no filter ID, got %q, %v", filterID, err)
+			}
+			for _, want := range []string{"1", "2"} {
+				if err := s.SaveFilterID(ctx, alice, want); err != nil {
+					t.Fatal(err)
+				}
+				if filterID, err := s.LoadFilterID(ctx, alice); err != nil || filterID != want {
+					t.Errorf("expected filter ID %q, got %q, %v", want, filterID, err)
+				}
+			}
+		}},
+		{"next batch", func(t *testing.T, ctx context.Context, s *store.StateStore) {
+			if token, err := s.LoadNextBatch(ctx, alice); err != nil || token != "" {
+				t.Fatalf("expected no sync token, got %q, %v", token, err)
+			}
+			for _, want := range []string{"s1", "s2"} {
+				if err := s.SaveNextBatch(ctx, alice, want); err != nil {
+					t.Fatal(err)
+				}
+				if token, err := s.LoadNextBatch(ctx, alice); err != nil || token != want {
+					t.Errorf("expected sync token %q, got %q, %v", want, token, err)
+				}
+			}
+		}},
+		{"membership", func(t *testing.T, ctx context.Context, s *store.StateStore) {
+			if member, err := s.TryGetMember(ctx, room1, alice); err != nil || member != nil {
+				t.Fatalf("expected an unknown member, got %v, %v", member, err)
+			}
+			if member, err := s.GetMember(ctx, room1, alice); err != nil || member.Membership != mevent.MembershipLeave {
+				t.Fatalf("expected an unknown member to have left, got %v, %v", member, err)
+			}
+
+			if err := s.SetMembership(ctx, room1, alice, mevent.MembershipInvite); err != nil {
+				t.Fatal(err)
+			}
+			if s.IsInRoom(ctx, room1, alice) || !s.IsInvited(ctx, room1, alice) {
+				t.Error("expected an invited member")
+			}
+			if err := s.SetMembership(ctx, room1, alice, mevent.MembershipJoin); err != nil {
+				t.Fatal(err)
+			}
+			if !s.IsInRoom(ctx, room1, alice) || !s.IsMembership(ctx, room1, alice, mevent.MembershipJoin) {
+				t.Error("expected a joined member")
+			}
+			if s.IsInRoom(ctx, room2, alice) {
+				t.Error("expected the membership to be per room")
+			}
+		}},
+		{"member profile", func(t *testing.T, ctx context.Context, s *store.StateStore) {
+			want := &mevent.MemberEventContent{
+				Membership:  mevent.MembershipJoin,
+				Displayname: "Alice",
+				AvatarURL:   "mxc://example.com/alice",
+			}
+			if err := s.SetMember(ctx, room1, alice, want); err != nil {
+				t.Fatal(err)
+			}
+			if member, err := s.GetMember(ctx, room1, alice); err != nil || !reflect.DeepEqual(member, want) {
+				t.Errorf("expected %+v, got %+v, %v", want, member, err)
+			}
+
+			// Changing only the membership keeps the profile
+			if err := s.SetMembership(ctx, room1, alice, mevent.MembershipLeave); err != nil {
+				t.Fatal(err)
+			}
+			if member, err := s.GetMember(ctx, room1, alice); err != nil || member.Membership != mevent.MembershipLeave || member.Displayname != "Alice" {
+				t.Errorf("expected Alice to have left, got %+v, %v", member, err)
+			}
+		}},
+		{"joined or invited members", func(t *testing.T, ctx context.Context, s *store.StateStore) {
+			s.SetMembership(ctx, room1, alice, mevent.MembershipJoin)
+			s.SetMembership(ctx, room1, bob, mevent.MembershipInvite)
+			s.SetMembership(ctx, room1, "@carol:example.com", mevent.MembershipLeave)
+			s.SetMembership(ctx, room2, "@dave:example.com", mevent.MembershipJoin)
+
+			members, err := s.GetRoomJoinedOrInvitedMembers(ctx, room1)
+			if want := []mid.UserID{alice, bob}; err != nil || !reflect.DeepEqual(sorted(members), want) {
+				t.Errorf("expected %v, got %v, %v", want, members, err)
+			}
+			if members, err := s.GetRoomJoinedOrInvitedMembers(ctx, "!empty:example.com"); err != nil || len(members) != 0 {
+				t.Errorf("expected no members, got %v, %v", members, err)
+			}
+		}},
+		{"clear cached members", func(t *testing.T, ctx context.Context, s *store.StateStore) {
+			s.SetMembership(ctx, room1, alice, mevent.MembershipJoin)
+			s.SetMembership(ctx, room1, bob, mevent.MembershipInvite)
+			s.SetMembership(ctx, room2, alice, mevent.MembershipJoin)
+
+			if err := s.ClearCachedMembers(ctx, room1, mevent.MembershipInvite); err != nil {
+				t.Fatal(err)
+			}
+			if !s.IsInRoom(ctx, room1, alice) || s.IsInvited(ctx, room1, bob) {
+				t.Error("expected only the invited members to be cleared")
+			}
+			if err := s.ClearCachedMembers(ctx, room1); err != nil {
+				t.Fatal(err)
+			}
+			if s.IsInRoom(ctx, room1, alice) || !s.IsInRoom(ctx, room2, alice) {
+				t.Error("expected only the members of the room to be cleared")
+			}
+		}},
+		{"find shared rooms", func(t *testing.T, ctx context.Context, s *store.StateStore) {
+			if rooms, err := s.FindSharedRooms(ctx, alice); err != nil || len(rooms) != 0 {
+				t.Fatalf("expected no shared rooms, got %v, %v", rooms, err)
+			}
+			s.SetMembership(ctx, room1, alice, mevent.MembershipJoin)
+			s.SetMembership(ctx, room2, alice, mevent.MembershipInvite)
+			s.SetMembership(ctx, "!left:example.com", alice, mevent.MembershipLeave)
+			s.SetMembership(ctx, room1, bob, mevent.MembershipJoin)
+
+			rooms, err := s.FindSharedRooms(ctx, alice)
+			if want := []mid.RoomID{room1, room2}; err != nil || !reflect.DeepEqual(sorted(rooms), want) {
+				t.Errorf("expected %v, got %v, %v", want, rooms, err)
+			}
+		}},
+		{"encryption", func(t *testing.T, ctx context.Context, s *store.StateStore) {
+			// A room that only has a name isn't encrypted either
+			s.SetRoomName(ctx, room2, "Two")
+			for _, roomID := range []mid.RoomID{room1, room2} {
+				if encrypted, err := s.IsEncrypted(ctx, roomID); err != nil || encrypted {
+					t.Fatalf("expected %s not to be encrypted, got %t, %v", roomID, encrypted, err)
+				}
+				if content, err := s.GetEncryptionEvent(ctx, roomID); err != nil || content != nil {
+					t.Fatalf("expected no encryption event in %s, got %v, %v", roomID, content, err)
+				}
+			}
+
+			want := &mevent.EncryptionEventContent{Algorithm: mid.AlgorithmMegolmV1, RotationPeriodMillis: 604800000}
+			if err := s.SetEncryptionEvent(ctx, room1, want); err != nil {
+				t.Fatal(err)
+			}
+			if encrypted, err := s.IsEncrypted(ctx, room1); err != nil || !encrypted {
+				t.Errorf("expected the room to be encrypted, got %t, %v", encrypted, err)
+			}
+			if content, err := s.GetEncryptionEvent(ctx, room1); err != nil || !reflect.DeepEqual(content, want) {
+				t.Errorf("expected %+v, got %+v, %v", want, content, err)
+			}
+		}},
+		{"update state", func(t *testing.T, ctx context.Context, s *store.StateStore) {
+			events := []*mevent.Event{
+				stateEvent(room1, mevent.StateMember, alice.String(), &mevent.MemberEventContent{Membership: mevent.MembershipJoin, Displayname: "Alice"}),
+				stateEvent(room1, mevent.StateRoomName, "", &mevent.RoomNameEventContent{Name: "One"}),
+				stateEvent(room1, mevent.StateTopic, "", &mevent.TopicEventContent{Topic: "The first room"}),
+				stateEvent(room1, mevent.StateEncryption, "", &mevent.EncryptionEventContent{Algorithm: mid.AlgorithmMegolmV1}),
+			}
+			for _, event := range events {
+				s.UpdateState(ctx, event)
+			}
+
+			if member, err := s.GetMember(ctx, room1, alice); err != nil || member.Displayname != "Alice" || !s.IsInRoom(ctx, room1, alice) {
+				t.Errorf("expected Alice to have joined, got %+v, %v", member, err)
+			}
+			if info, err := s.GetRoomInfo(ctx, room1); err != nil || info.Name != "One" || info.Topic != "The first room" {
+				t.Errorf("unexpected room info %+v, %v", info, err)
+			}
+			if encrypted, err := s.IsEncrypted(ctx, room1); err != nil || !encrypted {
+				t.Errorf("expected the room to be encrypted, got %t, %v", encrypted, err)
+			}
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			storetest.ForEachStore(t, func(t *testing.T, s *store.StateStore) {
+				test.run(t, context.Background(), s)
+			})
+		})
+	}
+}
@@ -1,64 +1,61 @@
 package store
 
 import (
+	"context"
 	"database/sql"
+	"embed"
+	"io/fs"
 
+	"github.com/rs/zerolog/log"
+	"go.mau.fi/util/dbutil"
 	"maunium.net/go/mautrix"
 )
 
-type StateStore struct {
-	DB     *sql.DB
-	Client *mautrix.Client
-}
+// VersionTable is the table that records which migrations have run.
+const VersionTable = "schema_version"
 
-func NewStateStore(db *sql.DB) *StateStore {
-	return &StateStore{DB: db}
-}
+// UpgradeTable holds the migrations of the bot's own tables. To change the
+// schema, add a migrations/NN-description.sql file starting with a
+// "-- vN -> vN+1: description" header, or a pair of NN-description.sqlite.sql
+// and NN-description.postgres.sql files when the dialects need different SQL.
+var UpgradeTable dbutil.UpgradeTable
+
+//go:embed migrations/*.sql
+var migrations embed.FS
 
-func (store *StateStore) CreateTables() error {
-	tx, err := store.DB.Begin()
+func init() {
+	// RegisterFSPath doesn't find the dialect specific files in a directory
+	dir, err := fs.Sub(migrations, "migrations")
 	if err != nil {
-		return err
+		panic(err)
 	}
+	UpgradeTable.RegisterFS(dir.(migrationFS))
+}
 
-	queries := []string{
-		`
-		CREATE TABLE IF NOT EXISTS user_filter_ids (
-			user_id    VARCHAR(255) PRIMARY KEY,
-			filter_id  VARCHAR(255)
-		)
-		`,
-		`
-		CREATE TABLE IF NOT EXISTS user_batch_tokens (
-			user_id           VARCHAR(255) PRIMARY KEY,
-			next_batch_token  VARCHAR(255)
-		)
-		`,
-		`
-		CREATE TABLE IF NOT EXISTS rooms (
-			room_id           VARCHAR(255) PRIMARY KEY,
-			encryption_event  VARCHAR(65535) NULL
-		)
-		`,
-		`
-		CREATE TABLE IF NOT EXISTS room_members (
-			room_id  VARCHAR(255),
-			user_id  VARCHAR(255),
-			PRIMARY KEY (room_id, user_id)
-		)
-		`,
-	}
+type migrationFS interface {
+	fs.ReadFileFS
+	fs.ReadDirFS
+}
 
-	for _, query := range queries {
-		if _, err := tx.Exec(query); err != nil {
-			_ = tx.Rollback()
-			return err
-		}
-	}
+// StateStore keeps the bot's state in SQLite or PostgreSQL. Queries use $n
+// placeholders and ON CONFLICT upserts, which both understand.
+type StateStore struct {
+	DB      *sql.DB
+	Dialect dbutil.Dialect
+	Client  *mautrix.Client
+}
 
-	if err = tx.Commit(); err != nil {
+func NewStateStore(db *sql.DB, dialect dbutil.Dialect) *StateStore {
+	return &StateStore{DB: db, Dialect: dialect}
+}
+
+// Upgrade brings the bot's tables up to date by running the migrations in
+// migrations/ that haven't run yet. The current version is kept in the
+// schema_version table.
+func (store *StateStore) Upgrade(ctx context.Context) error {
+	db, err := dbutil.NewWithDB(store.DB, store.Dialect.String())
+	if err != nil {
 		return err
 	}
-
-	return nil
+	return db.Child(VersionTable, UpgradeTable, dbutil.ZeroLogger(log.Logger)).Upgrade(ctx)
 }
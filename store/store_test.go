@@ -0,0 +1,60 @@
+package store_test
+
+import (
+	"bot/store"
+	"bot/store/storetest"
+	"context"
+	"database/sql"
+	"testing"
+
+	"go.mau.fi/util/dbutil"
+	mid "maunium.net/go/mautrix/id"
+)
+
+func TestUpgrade(t *testing.T) {
+	storetest.ForEachDialect(t, func(t *testing.T, db *sql.DB, dialect dbutil.Dialect) {
+		ctx := context.Background()
+
+		// A database from before schema versioning already has some tables
+		if _, err := db.Exec(`CREATE TABLE blocked_users (user_id VARCHAR(255) PRIMARY KEY, blocked_by VARCHAR(255), created_at BIGINT)`); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Exec(`INSERT INTO blocked_users VALUES ('@spam:example.com', '@admin:example.com', 0)`); err != nil {
+			t.Fatal(err)
+		}
+		// Rooms used to store the whole encryption event, as bytes
+		if _, err := db.Exec(`CREATE TABLE rooms (room_id VARCHAR(255) PRIMARY KEY, encryption_event VARCHAR(65535) NULL)`); err != nil {
+			t.Fatal(err)
+		}
+		encryptionEvent := `{"type":"m.room.encryption","state_key":"","content":{"algorithm":"m.megolm.v1.aes-sha2","rotation_period_ms":3600000,"rotation_period_msgs":10}}`
+		if _, err := db.Exec(`INSERT INTO rooms VALUES ('!room:example.com', $1)`, []byte(encryptionEvent)); err != nil {
+			t.Fatal(err)
+		}
+
+		stateStore := store.NewStateStore(db, dialect)
+		for i := 0; i < 2; i++ {
+			if err := stateStore.Upgrade(ctx); err != nil {
+				t.Fatalf("upgrade %d failed: %s", i+1, err)
+			}
+		}
+
+		var version int
+		if err := db.QueryRow(`SELECT version FROM ` + store.VersionTable).Scan(&version); err != nil {
+			t.Fatal(err)
+		}
+		if version != len(store.UpgradeTable) {
+			t.Errorf("expected schema version %d, got %d", len(store.UpgradeTable), version)
+		}
+
+		if blocked, err := stateStore.IsBlocked(ctx, "@spam:example.com"); err != nil || !blocked {
+			t.Errorf("expected existing rows to survive the upgrade, got %t, %v", blocked, err)
+		}
+		content, err := stateStore.GetEncryptionEvent(ctx, "!room:example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if content == nil || content.Algorithm != mid.AlgorithmMegolmV1 || content.RotationPeriodMillis != 3600000 || content.RotationPeriodMessages != 10 {
+			t.Errorf("expected the encryption event content to survive the upgrade, got %+v", content)
+		}
+	})
+}
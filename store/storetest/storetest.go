@@ -0,0 +1,109 @@
+// Package storetest runs tests against every database the store supports.
+//
+// SQLite tests use a fresh in-memory database. PostgreSQL tests run when
+// BOT_TEST_POSTGRES_URI points at a database the tests may create schemas in,
+// e.g. postgres://postgres@localhost/bot_test?sslmode=disable. Each test gets
+// a schema of its own, which is dropped afterwards.
+package storetest
+
+import (
+	"bot/store"
+	"context"
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"net/url"
+	"os"
+	"testing"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+	"go.mau.fi/util/dbutil"
+)
+
+// PostgresURIEnv is the environment variable with the PostgreSQL database to
+// test against.
+const PostgresURIEnv = "BOT_TEST_POSTGRES_URI"
+
+// ForEachDialect runs fn as a subtest with an empty database of every dialect.
+func ForEachDialect(t *testing.T, fn func(t *testing.T, db *sql.DB, dialect dbutil.Dialect)) {
+	t.Run("sqlite", func(t *testing.T) {
+		fn(t, openSQLite(t), dbutil.SQLite)
+	})
+	t.Run("postgres", func(t *testing.T) {
+		fn(t, openPostgres(t), dbutil.Postgres)
+	})
+}
+
+// ForEachStore runs fn as a subtest with an empty, upgraded store in every
+// dialect.
+func ForEachStore(t *testing.T, fn func(t *testing.T, stateStore *store.StateStore)) {
+	ForEachDialect(t, func(t *testing.T, db *sql.DB, dialect dbutil.Dialect) {
+		stateStore := store.NewStateStore(db, dialect)
+		if err := stateStore.Upgrade(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		fn(t, stateStore)
+	})
+}
+
+// SQLite returns an empty, upgraded store in an in-memory SQLite database, for
+// tests that don't depend on the dialect.
+func SQLite(t *testing.T) *store.StateStore {
+	stateStore := store.NewStateStore(openSQLite(t), dbutil.SQLite)
+	if err := stateStore.Upgrade(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return stateStore
+}
+
+func openSQLite(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every connection would get its own in-memory database
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func openPostgres(t *testing.T) *sql.DB {
+	uri := os.Getenv(PostgresURIEnv)
+	if uri == "" {
+		t.Skipf("set %s to test against PostgreSQL", PostgresURIEnv)
+	}
+
+	admin, err := sql.Open("postgres", uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { admin.Close() })
+
+	schema := fmt.Sprintf("bot_test_%d", rand.Int63())
+	if _, err := admin.Exec("CREATE SCHEMA " + schema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if _, err := admin.Exec("DROP SCHEMA " + schema + " CASCADE"); err != nil {
+			t.Errorf("couldn't drop test schema %s: %s", schema, err)
+		}
+	})
+
+	// lib/pq passes unknown parameters on as run-time settings
+	u, err := url.Parse(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := u.Query()
+	query.Set("search_path", schema)
+	u.RawQuery = query.Encode()
+
+	db, err := sql.Open("postgres", u.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Registered after dropping the schema, so it runs first
+	t.Cleanup(func() { db.Close() })
+	return db
+}
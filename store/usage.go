@@ -0,0 +1,123 @@
+//
+// Records every job in the usage ledger and summarizes it
+//
+
+package store
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+type UsageEntry struct {
+	CreatedAt        time.Time `json:"created_at"`
+	UserID           string    `json:"user_id"`
+	RoomID           string    `json:"room_id"`
+	Kind             string    `json:"kind"`
+	Backend          string    `json:"backend"`
+	Model            string    `json:"model"`
+	PromptTokens     int       `json:"prompt_tokens"`
+	CompletionTokens int       `json:"completion_tokens"`
+	Images           int       `json:"images"`
+	Duration         int64     `json:"duration_ms"`
+	Success          bool      `json:"success"`
+	Error            string    `json:"error,omitempty"`
+}
+
+type UsageSummary struct {
+	Key      string
+	Jobs     int
+	Failures int
+	Tokens   int
+	Images   int
+	Duration time.Duration
+}
+
+// Columns that usage can be grouped by in SummarizeUsage.
+const (
+	GroupByUser = "user_id"
+	GroupByRoom = "room_id"
+	GroupByDay  = "day"
+)
+
+func (store *StateStore) RecordUsage(ctx context.Context, entry UsageEntry) error {
+	insert := `
+		INSERT INTO usage_ledger (created_at, day, user_id, room_id, kind, backend, model,
+			prompt_tokens, completion_tokens, images, duration_ms, success, error)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+	`
+	_, err := store.DB.ExecContext(ctx, insert,
+		entry.CreatedAt.UnixMilli(), entry.CreatedAt.UTC().Format("2006-01-02"),
+		entry.UserID, entry.RoomID, entry.Kind, entry.Backend, entry.Model,
+		entry.PromptTokens, entry.CompletionTokens, entry.Images, entry.Duration,
+		entry.Success, entry.Error)
+	return err
+}
+
+// SummarizeUsage aggregates the jobs since the given time, grouped by one of
+// GroupByUser, GroupByRoom or GroupByDay. If roomID is not empty, only jobs in
+// that room are considered.
+func (store *StateStore) SummarizeUsage(ctx context.Context, since time.Time, roomID, groupBy string) ([]UsageSummary, error) {
+	switch groupBy {
+	case GroupByUser, GroupByRoom, GroupByDay:
+	default:
+		return nil, fmt.Errorf("can't group usage by %q", groupBy)
+	}
+
+	query := `
+		SELECT ` + groupBy + `, COUNT(*),
+			SUM(CASE WHEN success THEN 0 ELSE 1 END),
+			SUM(prompt_tokens + completion_tokens), SUM(images), SUM(duration_ms)
+		FROM usage_ledger
+		WHERE created_at >= $1 AND ($2 = '' OR room_id = $2)
+		GROUP BY ` + groupBy + `
+		ORDER BY ` + groupBy + `
+	`
+	rows, err := store.DB.QueryContext(ctx, query, since.UnixMilli(), roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	summaries := make([]UsageSummary, 0)
+	for rows.Next() {
+		var summary UsageSummary
+		var duration int64
+		if err := rows.Scan(&summary.Key, &summary.Jobs, &summary.Failures, &summary.Tokens, &summary.Images, &duration); err != nil {
+			return nil, err
+		}
+		summary.Duration = time.Duration(duration) * time.Millisecond
+		summaries = append(summaries, summary)
+	}
+	return summaries, rows.Err()
+}
+
+// ListUsage returns every ledger entry since the given time, oldest first.
+func (store *StateStore) ListUsage(ctx context.Context, since time.Time) ([]UsageEntry, error) {
+	query := `
+		SELECT created_at, user_id, room_id, kind, backend, model,
+			prompt_tokens, completion_tokens, images, duration_ms, success, error
+		FROM usage_ledger
+		WHERE created_at >= $1
+		ORDER BY created_at
+	`
+	rows, err := store.DB.QueryContext(ctx, query, since.UnixMilli())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make([]UsageEntry, 0)
+	for rows.Next() {
+		var entry UsageEntry
+		var createdAt int64
+		if err := rows.Scan(&createdAt, &entry.UserID, &entry.RoomID, &entry.Kind, &entry.Backend, &entry.Model,
+			&entry.PromptTokens, &entry.CompletionTokens, &entry.Images, &entry.Duration, &entry.Success, &entry.Error); err != nil {
+			return nil, err
+		}
+		entry.CreatedAt = time.UnixMilli(createdAt)
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
@@ -2,17 +2,20 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"net/url"
+	"path"
 	"regexp"
 	"strconv"
 	"strings"
 
-	"github.com/rs/zerolog/log"
-	mevent "maunium.net/go/mautrix/event"
+	"github.com/rs/zerolog"
 )
 
 type txt2img_request struct {
@@ -89,6 +92,13 @@ type txt2img_response struct {
 	Info string `json:"info"`
 }
 
+// txt2img_info holds the generation details that the API returns as a JSON
+// encoded string in the info field of the response.
+type txt2img_info struct {
+	Seed        int    `json:"seed"`
+	SDModelName string `json:"sd_model_name"`
+}
+
 func ParsePromptForTxt2Img(prompt string) txt2img_request {
 	var request txt2img_request
 	forcedSettings := map[string]bool{}
@@ -100,69 +110,140 @@ func ParsePromptForTxt2Img(prompt string) txt2img_request {
 	request.HRUpscaler = "4x_Valar_v1"
 	request.Steps = 20
 
+	prompt = parseSettings(prompt, func(setting, value string) bool {
+		return handleSetting(&request, &forcedSettings, setting, value)
+	})
+
+	if !forcedSettings["ds"] && request.EnableHR {
+		request.DenoisingStrength = 0.7
+	}
+
+	request.Prompt, request.NegativePrompt = splitPrompt(prompt)
+
+	return request
+}
+
+// parseSettings removes the setting:value pairs that handle accepts from the
+// prompt and returns the rest of it.
+func parseSettings(prompt string, handle func(setting, value string) bool) string {
 	var re = regexp.MustCompile(`(\S+):(\S+)`)
 	matches := re.FindAllStringSubmatch(prompt, -1)
 	for _, match := range matches {
-		if ok := handleSetting(&request, &forcedSettings, match[1], match[2]); ok {
-			replacement := regexp.MustCompile(`\s*` + match[0] + `\s*`)
+		if ok := handle(match[1], match[2]); ok {
+			replacement := regexp.MustCompile(`\s*` + regexp.QuoteMeta(match[0]) + `\s*`)
 			if found := replacement.FindString(prompt); found != "" {
 				prompt = strings.Replace(prompt, found, " ", 1)
 			}
 		}
 	}
+	return prompt
+}
 
-	if !forcedSettings["ds"] && request.EnableHR {
-		request.DenoisingStrength = 0.7
-	}
-
+// splitPrompt splits a prompt into the positive and the negative prompt after
+// ###.
+func splitPrompt(prompt string) (string, string) {
 	prompts := strings.Split(prompt, "###")
-	request.Prompt = strings.TrimSpace(prompts[0])
 	if len(prompts) == 2 {
-		request.NegativePrompt = strings.TrimSpace(prompts[1])
+		return strings.TrimSpace(prompts[0]), strings.TrimSpace(prompts[1])
 	}
+	return strings.TrimSpace(prompts[0]), ""
+}
 
-	return request
+// imageCount returns how many images the backend will generate for a request.
+func imageCount(request txt2img_request) int {
+	return max(request.NIter, 1) * max(request.BatchSize, 1)
 }
 
-func getImageForPrompt(event *mevent.Event, prompt string) ([]byte, error) {
-	req_body := ParsePromptForTxt2Img(prompt)
+// automatic1111 generates images with the API of the Stable Diffusion web UI
+// at txt2img_api_url.
+type automatic1111 struct{}
 
-	json_body, err := json.Marshal(req_body)
-	if err != nil {
-		log.Error().Err(err).Msg("Failed to marshal fields to JSON")
-		return nil, err
-	}
+func (a automatic1111) GenerateImage(ctx context.Context, request txt2img_request) ([]byte, txt2img_info, error) {
+	return a.generate(ctx, Bot.Config().Txt2ImgAPIURL, request)
+}
 
-	resp, err := http.Post(Bot.configuration.Txt2ImgAPIURL, "application/json", bytes.NewBuffer(json_body))
-	if err != nil {
-		log.Error().Err(err).Msg("Failed to POST to SD API")
-		return nil, err
-	}
-	defer resp.Body.Close()
+func (a automatic1111) EditImage(ctx context.Context, request img2img_request) ([]byte, txt2img_info, error) {
+	return a.generate(ctx, sdAPIURL("img2img"), request)
+}
 
-	fmt.Println("response Status:", resp.Status)
-	fmt.Println("response Headers:", resp.Header)
+// generate posts a request to one of the image generation endpoints and
+// returns the first image of the response.
+func (a automatic1111) generate(ctx context.Context, apiURL string, request any) ([]byte, txt2img_info, error) {
+	logger := zerolog.Ctx(ctx)
+	var info txt2img_info
 
 	var res txt2img_response
-	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
-		log.Error().Err(err).Msg("Couldn't decode the response")
-		return nil, err
+	if err := a.post(ctx, apiURL, request, &res); err != nil {
+		return nil, info, err
+	}
+
+	if err := json.Unmarshal([]byte(res.Info), &info); err != nil {
+		logger.Warn().Err(err).Msg("Couldn't decode the generation info")
 	}
 
 	if len(res.Images) == 0 {
-		return nil, errors.New("No images in response")
+		return nil, info, errors.New("No images in response")
 	}
 
 	encoded_image := res.Images[0]
 	//for _, encoded_image := range res.Images {
 	image, err := base64.StdEncoding.DecodeString(encoded_image)
 	if err != nil {
-		log.Error().Err(err).Msg("Failed to decode the image")
+		logger.Error().Err(err).Msg("Failed to decode the image")
 		//continue
-		return nil, err
+		return nil, info, err
 	}
 	//}
-	return image, err
+	return image, info, err
+}
+
+// post posts a request to an endpoint of the API and decodes the response.
+func (automatic1111) post(ctx context.Context, apiURL string, request, response any) error {
+	logger := zerolog.Ctx(ctx)
+
+	json_body, err := json.Marshal(request)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to marshal fields to JSON")
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", apiURL, bytes.NewBuffer(json_body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to POST to SD API")
+		return err
+	}
+	defer resp.Body.Close()
+
+	logger.Debug().Msgf("%s response status: %s", path.Base(req.URL.Path), resp.Status)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		err := fmt.Errorf("%s returned %s: %s", path.Base(req.URL.Path), resp.Status, strings.TrimSpace(string(body)))
+		logger.Error().Err(err).Msg("SD API request failed")
+		return err
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(response); err != nil {
+		logger.Error().Err(err).Msg("Couldn't decode the response")
+		return err
+	}
+	return nil
+}
+
+// sdAPIURL returns the URL of an endpoint next to txt2img_api_url, such as
+// img2img.
+func sdAPIURL(endpoint string) string {
+	base, err := url.Parse(Bot.Config().Txt2ImgAPIURL)
+	if err != nil {
+		return endpoint
+	}
+	return base.ResolveReference(&url.URL{Path: endpoint}).String()
 }
 
 func handleSetting(request *txt2img_request, forcedSettings *map[string]bool, setting, value string) bool {
@@ -10,15 +10,22 @@ import (
 	"math/big"
 	"net/http"
 	"os"
+	"slices"
 	"strings"
+	"sync"
 
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
-	"maunium.net/go/mautrix/event"
+	mid "maunium.net/go/mautrix/id"
 )
 
 type Txt2txt struct {
 	aiCharacter AICharacter
-	Histories   map[string][]Message
+	historyFile string
+
+	// lock guards Histories, which chats in different rooms update at once
+	lock      sync.Mutex
+	Histories map[string][]Message
 }
 
 type AICharacter struct {
@@ -64,6 +71,8 @@ type Message struct {
 	Content string `json:"content"`
 }
 
+const txt2txtModel = "wolfram/miqu-1-120b"
+
 func dataForPrompt(username, user_input string, history []Message) RequestData {
 	return RequestData{
 		Messages: append(history, Message{
@@ -71,7 +80,7 @@ func dataForPrompt(username, user_input string, history []Message) RequestData {
 			Content: user_input,
 		}),
 		//Mode:   "chat",
-		Model:  "wolfram/miqu-1-120b",
+		Model:  txt2txtModel,
 		Stream: true,
 		User:   username,
 		//Character: Bot.txt2txt.aiCharacter.name,
@@ -82,7 +91,7 @@ func dataForPrompt(username, user_input string, history []Message) RequestData {
 	}
 }
 
-func NewTxt2txt() *Txt2txt {
+func NewTxt2txt(historyFile string) *Txt2txt {
 	instructions_body, err := os.ReadFile("prompts_instructions.md")
 	if err != nil {
 		log.Fatal().Msg("Couldn't read prompts_instructions.md")
@@ -93,17 +102,26 @@ func NewTxt2txt() *Txt2txt {
 			name:         "TavernAI-Gray", // TODO
 			instructions: string(instructions_body),
 		},
-		Histories: make(map[string][]Message),
+		historyFile: historyFile,
+		Histories:   make(map[string][]Message),
 	}
 }
 
 func (b *Txt2txt) SaveHistories() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.saveHistories()
+}
+
+// saveHistories writes the histories to the history file. The lock must be
+// held.
+func (b *Txt2txt) saveHistories() error {
 	data, err := json.MarshalIndent(b.Histories, "", "  ")
 	if err != nil {
 		return err
 	}
 
-	err = os.WriteFile(Bot.configuration.Txt2TxtHistoryFile, data, 0644)
+	err = os.WriteFile(b.historyFile, data, 0644)
 	if err != nil {
 		return err
 	}
@@ -112,11 +130,14 @@ func (b *Txt2txt) SaveHistories() error {
 }
 
 func (b *Txt2txt) LoadHistories() error {
-	data, err := os.ReadFile(Bot.configuration.Txt2TxtHistoryFile)
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	data, err := os.ReadFile(b.historyFile)
 	if err != nil {
 		if os.IsNotExist(err) {
 			b.Histories = map[string][]Message{}
-			b.SaveHistories()
+			b.saveHistories()
 			return nil
 		}
 		return err
@@ -128,76 +149,114 @@ func (b *Txt2txt) LoadHistories() error {
 	return nil
 }
 
-func (b *Txt2txt) GetPredictionForPrompt(event *event.Event, prompt string) (string, error) {
-	history := b.Histories[string(event.RoomID)]
+// Forget drops the conversation in the room and saves the histories.
+func (b *Txt2txt) Forget(roomID mid.RoomID) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	delete(b.Histories, string(roomID))
+	return b.saveHistories()
+}
+
+// GetPredictionForPrompt asks the chat backend to continue the conversation in
+// the room with the prompt, and remembers the reply. The persona, if any, is
+// sent as a system message ahead of the conversation but isn't remembered.
+func (b *Txt2txt) GetPredictionForPrompt(ctx context.Context, chat ChatBackend, roomID mid.RoomID, username, persona, prompt string) (string, Usage, error) {
+	// Copy the history, the request appends to it
+	b.lock.Lock()
+	history := slices.Clone(b.Histories[string(roomID)])
+	b.lock.Unlock()
 	if len(history) == 0 {
 		history = []Message{}
 	}
 
-	username, err := Bot.client.GetDisplayName(context.Background(), event.Sender)
-	if err != nil {
-		return prompt, err
+	if persona != "" {
+		history = append([]Message{{Role: "system", Content: persona}}, history...)
 	}
-	reply, err := run(dataForPrompt(username.DisplayName, prompt, history))
+	reply, usage, err := chat.Complete(ctx, dataForPrompt(username, prompt, history))
 	if err != nil {
-		fmt.Println("Error:", err)
-		return prompt, err
+		zerolog.Ctx(ctx).Error().Err(err).Msg("Failed to get a reply")
+		return prompt, usage, err
 	}
 
+	if persona != "" && len(reply) > 0 {
+		reply = reply[1:]
+	}
 	if len(reply) > 0 {
-		b.Histories[string(event.RoomID)] = reply
-		b.SaveHistories()
+		b.lock.Lock()
+		b.Histories[string(roomID)] = reply
+		b.saveHistories()
+		b.lock.Unlock()
 	}
 
-	log.Debug().Msgf("Bot response: %s", reply)
-	return reply[len(reply)-1].Content, nil
+	zerolog.Ctx(ctx).Debug().Msgf("Bot response: %s", redact(reply[len(reply)-1].Content))
+	return reply[len(reply)-1].Content, usage, nil
 }
 
-func run(requestData RequestData) ([]Message, error) {
+// EstimateTokens roughly estimates the prompt tokens of a reply in the room,
+// at four characters per token, to reserve them in the daily quotas before
+// the backend reports the actual usage.
+func (b *Txt2txt) EstimateTokens(roomID mid.RoomID, persona, prompt string) int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	chars := len(persona) + len(prompt)
+	for _, message := range b.Histories[string(roomID)] {
+		chars += len(message.Content)
+	}
+	return chars/4 + 1
+}
+
+// openAIChat streams chat completions from the OpenAI compatible API at
+// txt2txt_api_url.
+type openAIChat struct{}
+
+func (openAIChat) Complete(ctx context.Context, requestData RequestData) ([]Message, Usage, error) {
 	// Marshal the request data to JSON
 	requestDataBytes, err := json.Marshal(requestData)
 	if err != nil {
-		return requestData.Messages, err
+		return requestData.Messages, Usage{}, err
 	}
 
 	// Create a new request
-	req, err := http.NewRequest("POST", Bot.configuration.Txt2TxtAPIURL, bytes.NewBuffer(requestDataBytes))
+	req, err := http.NewRequestWithContext(ctx, "POST", Bot.Config().Txt2TxtAPIURL, bytes.NewBuffer(requestDataBytes))
 	if err != nil {
-		return requestData.Messages, err
+		return requestData.Messages, Usage{}, err
 	}
 	req.Header.Set("Content-Type", "application/json")
 
-	fmt.Print("Request data: ", req.Body)
+	logger := zerolog.Ctx(ctx)
+	logger.Debug().Msgf("Sending %d messages to %s", len(requestData.Messages), backendName(req.URL.String()))
 
 	// Execute the request
 	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
-		return requestData.Messages, err
+		return requestData.Messages, Usage{}, err
 	}
 	defer resp.Body.Close()
 
 	// Ensure we only accept a 200 OK response indicating that the SSE stream is established
 	if resp.StatusCode != http.StatusOK {
-		return requestData.Messages, fmt.Errorf("received non-200 status code: %d", resp.StatusCode)
+		return requestData.Messages, Usage{}, fmt.Errorf("received non-200 status code: %d", resp.StatusCode)
 	}
 
 	// Create a buffered reader for the response body to read line by line
 	reader := bufio.NewReader(resp.Body)
 	var result []Message
+	var usage Usage
 
 	var currentMessageContent string
 processLoop:
 	for {
 		line, err := reader.ReadBytes('\n')
-		log.Debug().Msgf("Received line: %s", line)
+		logger.Trace().Msgf("Received line: %s", redact(string(line)))
 		if err != nil {
 			if err.Error() == "EOF" {
-				log.Error().Err(err).Msg("Unexpected EOF")
+				logger.Error().Err(err).Msg("Unexpected EOF")
 				break
 			}
-			log.Error().Err(err).Msg("Error reading line")
-			return requestData.Messages, err
+			logger.Error().Err(err).Msg("Error reading line")
+			return requestData.Messages, Usage{}, err
 		}
 
 		if string(line) == "data: [DONE]" {
@@ -217,10 +276,9 @@ processLoop:
 
 			err = json.Unmarshal(dataBytes, &incomingData)
 			if err != nil {
-				log.Error().Err(err).Msg("Error unmarshalling incoming data")
-				return requestData.Messages, err
+				logger.Error().Err(err).Msg("Error unmarshalling incoming data")
+				return requestData.Messages, Usage{}, err
 			}
-			log.Debug().Msgf("Incoming data: %+v", incomingData)
 
 			currentMessageContent += incomingData.Choices[0].Delta.Content
 
@@ -229,14 +287,15 @@ processLoop:
 					Role:    incomingData.Choices[0].Delta.Role,
 					Content: currentMessageContent,
 				})
-				log.Info().Msgf("Prompt tokens: %d, Completion tokens: %d, Total tokens: %d",
+				logger.Info().Msgf("Prompt tokens: %d, Completion tokens: %d, Total tokens: %d",
 					incomingData.Usage.PromptTokens, incomingData.Usage.CompletionTokens, incomingData.Usage.TotalTokens)
+				usage = incomingData.Usage
 				currentMessageContent = ""
 				break processLoop
 			}
 		}
 	}
-	return result, nil
+	return result, usage, nil
 }
 
 func randomHash() string {
@@ -2,17 +2,33 @@ package main
 
 import (
 	"bot/store"
+	"net/http"
+	"sync"
+	"sync/atomic"
 
 	"github.com/rs/zerolog"
-	"maunium.net/go/mautrix"
-	mcrypto "maunium.net/go/mautrix/crypto"
 )
 
 type BotType struct {
-	client        *mautrix.Client
-	configuration Configuration
-	olmMachine    *mcrypto.OlmMachine
+	configuration atomic.Pointer[Configuration]
+	configPath    string
+	accounts      []*Account
 	stateStore    *store.StateStore
-	txt2txt       *Txt2txt
+	limiter       *Limiter
 	log           *zerolog.Logger
+	httpServer    *http.Server
+
+	// Message handlers that are still running, and whether new ones are
+	// refused because the bot is shutting down. The lock makes sure no
+	// handler is added once shutdown started waiting for them.
+	handlersLock sync.Mutex
+	handlers     sync.WaitGroup
+	shuttingDown bool
+}
+
+// Config returns the current configuration. It can be replaced at any time by
+// a reload, so callers that need several settings to be consistent with each
+// other should call it once and keep the result.
+func (b *BotType) Config() *Configuration {
+	return b.configuration.Load()
 }
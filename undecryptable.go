@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	mcrypto "maunium.net/go/mautrix/crypto"
+	mevent "maunium.net/go/mautrix/event"
+	mid "maunium.net/go/mautrix/id"
+)
+
+const undecryptableReaction = "🔒"
+
+// pendingDecryption is an encrypted event parked until its Megolm session
+// arrives.
+type pendingDecryption struct {
+	Event    *mevent.Event
+	Received time.Time
+
+	// reacted is closed once the reaction was sent, or failed to send, and
+	// reaction is then its event ID. It's nil when the bot doesn't react.
+	reacted  chan struct{}
+	reaction mid.EventID
+}
+
+// megolmSession identifies a Megolm session. Session IDs are chosen by the
+// sender, so they are only trusted together with the room and the sender key.
+type megolmSession struct {
+	RoomID    mid.RoomID
+	SenderKey mid.SenderKey
+	SessionID mid.SessionID
+}
+
+// undecryptableEvents holds an account's parked events by session, so that the
+// keys are only requested once however many messages use the session.
+type undecryptableEvents struct {
+	sync.Mutex
+	events map[megolmSession][]*pendingDecryption
+}
+
+// decryptEvent decrypts a Megolm event, falling back to the key backup when
+// the session isn't in the crypto store.
+func (a *Account) decryptEvent(ctx context.Context, event *mevent.Event) (*mevent.Event, error) {
+	decrypted, err := a.olmMachine.DecryptMegolmEvent(ctx, event)
+	if errors.Is(err, mcrypto.NoSessionFound) && a.keyBackup != nil {
+		content := event.Content.AsEncrypted()
+		if restoreErr := a.keyBackup.RestoreSession(ctx, event.RoomID, content.SessionID); restoreErr == nil {
+			decrypted, err = a.olmMachine.DecryptMegolmEvent(ctx, event)
+		}
+	}
+	return decrypted, err
+}
+
+// parkUndecryptable asks the sender's devices for the session of an event we
+// have no keys for and hands the event to handle once they arrive. Events are
+// dropped, and their reaction removed, if the keys don't arrive within
+// decryption_timeout.
+func (a *Account) parkUndecryptable(event *mevent.Event, handle func(*mevent.Event)) {
+	config := Bot.Config()
+	content := event.Content.AsEncrypted()
+	session := megolmSession{event.RoomID, content.SenderKey, content.SessionID}
+	pending := &pendingDecryption{Event: event, Received: time.Now()}
+
+	if config.ReactToUndecryptable {
+		// Don't hold up the sync while the reaction is sent
+		pending.reacted = make(chan struct{})
+		go func() {
+			defer close(pending.reacted)
+			if resp, err := a.client.SendReaction(context.Background(), event.RoomID, event.ID, undecryptableReaction); err != nil {
+				log.Warn().Err(err).Msgf("Failed to react to undecryptable event %s", event.ID)
+			} else {
+				pending.reaction = resp.EventID
+			}
+		}()
+	}
+
+	a.undecryptable.Lock()
+	waiting := len(a.undecryptable.events[session]) > 0
+	a.undecryptable.events[session] = append(a.undecryptable.events[session], pending)
+	a.undecryptable.Unlock()
+	if waiting {
+		return
+	}
+
+	log.Info().Msgf("Requesting session %s from %s for event %s in %s", content.SessionID, event.Sender, event.ID, event.RoomID)
+	go func() {
+		ctx := context.Background()
+		timeout := time.Duration(config.DecryptionTimeout) * time.Second
+		a.client.Crypto.RequestSession(ctx, event.RoomID, content.SenderKey, content.SessionID, event.Sender, content.DeviceID)
+		found := a.olmMachine.WaitForSession(ctx, event.RoomID, content.SenderKey, content.SessionID, timeout)
+
+		a.undecryptable.Lock()
+		events := a.undecryptable.events[session]
+		delete(a.undecryptable.events, session)
+		a.undecryptable.Unlock()
+
+		for _, pending := range events {
+			// The reaction goes either way, the bot isn't waiting anymore
+			if pending.reacted != nil {
+				<-pending.reacted
+			}
+			if pending.reaction != "" {
+				if _, err := a.client.RedactEvent(ctx, pending.Event.RoomID, pending.reaction); err != nil {
+					log.Warn().Err(err).Msgf("Failed to remove the reaction from %s", pending.Event.ID)
+				}
+			}
+			if !found {
+				decryptionFailures.WithLabelValues("timeout").Inc()
+				log.Warn().Msgf("Gave up on event %s from %s in %s, session %s didn't arrive in %s",
+					pending.Event.ID, pending.Event.Sender, pending.Event.RoomID, content.SessionID, timeout)
+				continue
+			}
+
+			decrypted, err := a.olmMachine.DecryptMegolmEvent(ctx, pending.Event)
+			if err != nil {
+				log.Error().Err(err).Msgf("Failed to decrypt event %s after its session arrived", pending.Event.ID)
+				continue
+			}
+			log.Info().Msgf("Decrypted event %s after waiting %s", pending.Event.ID, time.Since(pending.Received).Round(time.Second))
+			handle(decrypted)
+		}
+	}()
+}
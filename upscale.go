@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog"
+	mevent "maunium.net/go/mautrix/event"
+)
+
+const upscaleUsage = "reply to an image with `!upscale x2 upscaler:esrgan` to upscale it. " +
+	"the factor goes up to `x4`, and `fr:1` restores faces"
+
+// upscale_request is a request to the extras API to upscale a single image.
+type upscale_request struct {
+	Image            string  `json:"image"`
+	UpscalingResize  float32 `json:"upscaling_resize"`
+	Upscaler1        string  `json:"upscaler_1"`
+	GFPGANVisibility float32 `json:"gfpgan_visibility,omitempty"`
+}
+
+type upscale_response struct {
+	Image    string `json:"image"`
+	HTMLInfo string `json:"html_info"`
+}
+
+// ParseUpscaleOptions parses the options of !upscale: the factor as x2, and
+// the upscaler and fr settings.
+func ParseUpscaleOptions(options string) upscale_request {
+	request := upscale_request{
+		UpscalingResize: 2,
+		Upscaler1:       "4x_Valar_v1",
+	}
+
+	options = parseSettings(options, func(setting, value string) bool {
+		return handleUpscaleSetting(&request, setting, value)
+	})
+	for _, field := range strings.Fields(options) {
+		if !strings.HasPrefix(field, "x") {
+			continue
+		}
+		if v, err := strconv.ParseFloat(strings.TrimPrefix(field, "x"), 32); err == nil {
+			request.UpscalingResize = clampf(float32(v), 1, 4)
+		}
+	}
+
+	return request
+}
+
+func handleUpscaleSetting(request *upscale_request, setting, value string) bool {
+	// The latent upscalers of hires fix don't work on finished images
+	supportedUpscalers := map[string]string{
+		"valar":    "4x_Valar_v1",
+		"lanczos":  "Lanczos",
+		"nearest":  "Nearest",
+		"esrgan":   "ESRGAN_4x",
+		"lollypop": "lollypop",
+		"ldsr":     "LDSR",
+	}
+
+	switch setting {
+	case "upscaler":
+		if upscaler, ok := supportedUpscalers[value]; ok {
+			request.Upscaler1 = upscaler
+		}
+		return true
+	case "fr":
+		if v, err := strconv.ParseBool(value); err == nil {
+			request.GFPGANVisibility = 0
+			if v {
+				request.GFPGANVisibility = 1
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func (a automatic1111) UpscaleImage(ctx context.Context, request upscale_request) ([]byte, error) {
+	var res upscale_response
+	if err := a.post(ctx, sdAPIURL("extra-single-image"), request, &res); err != nil {
+		return nil, err
+	}
+	if res.Image == "" {
+		return nil, errors.New("No image in response")
+	}
+	return base64.StdEncoding.DecodeString(res.Image)
+}
+
+// upscaleMaxPixels is the largest upscaled image, in pixels, that the bot
+// asks for. Larger ones take the backend long and may have to be decoded to
+// fit in the upload limit.
+const upscaleMaxPixels = 4096 * 4096
+
+// handleUpscale upscales the image that the message replies to.
+func (h *Handler) handleUpscale(ctx context.Context, event *mevent.Event, content *mevent.MessageEventContent, options string) {
+	request := ParseUpscaleOptions(options)
+
+	_, data, ok := h.repliedImage(ctx, event, content, upscaleUsage)
+	if !ok {
+		return
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		h.sendReply(ctx, event, "Couldn't read the image you replied to")
+		return
+	}
+	factor := float64(request.UpscalingResize)
+	if float64(cfg.Width)*float64(cfg.Height)*factor*factor > upscaleMaxPixels {
+		h.sendReply(ctx, event, fmt.Sprintf("The image is too large to upscale x%g, the result can have up to %d megapixels",
+			factor, upscaleMaxPixels/1_000_000))
+		return
+	}
+	request.Image = base64.StdEncoding.EncodeToString(data)
+
+	h.generateImage(ctx, event, jobKindUpscale, 1, func(ctx context.Context) ([]byte, txt2img_info, error) {
+		image, err := h.images.UpscaleImage(ctx, request)
+		return image, txt2img_info{SDModelName: request.Upscaler1}, err
+	}, func(data []byte, _ txt2img_info) {
+		h.sendUpscaled(ctx, event, data)
+	})
+}
+
+// sendUpscaled sends an upscaled image. When it's larger than the homeserver
+// accepts, it's sent as a JPEG file instead, which clients offer to download
+// at full size rather than showing a preview.
+func (h *Handler) sendUpscaled(ctx context.Context, event *mevent.Event, data []byte) {
+	logger := zerolog.Ctx(ctx)
+	limit, err := h.sender.MaxUploadSize(ctx)
+	if err != nil {
+		logger.Warn().Err(err).Msg("Couldn't get the media upload limit")
+	}
+	if limit == 0 || int64(len(data)) <= limit {
+		h.sendImage(ctx, event, "upscaled.png", data)
+		return
+	}
+
+	var file bytes.Buffer
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err == nil {
+		err = jpeg.Encode(&file, src, &jpeg.Options{Quality: 90})
+	}
+	if err != nil || int64(file.Len()) > limit {
+		logger.Warn().Err(err).Msgf("Upscaled image of %d bytes doesn't fit in the upload limit of %d bytes", len(data), limit)
+		h.sendReply(ctx, event, "The upscaled image is too large for the homeserver, try a smaller factor")
+		return
+	}
+	h.sendFile(ctx, event, "upscaled.jpg", "image/jpeg", file.Bytes())
+}